@@ -0,0 +1,169 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+
+	"github.com/stevegt/aidss/tree"
+)
+
+// quietPeriod is how long a file must go without events before a
+// change to it is acted on.  Editors that save in several writes, or
+// by writing a temporary file and renaming it into place, generate a
+// burst of events that all fall within it.
+const quietPeriod = 300 * time.Millisecond
+
+// debouncer coalesces the events for each file over a quiet period,
+// then calls fire for the file if its content has changed since fire
+// was last called for it.
+type debouncer struct {
+	quiet time.Duration
+	fire  func(name string)
+
+	mu      sync.Mutex
+	timers  map[string]*time.Timer
+	hashes  map[string]string // content hash when last fired, by file
+	stopped bool
+}
+
+// newDebouncer returns a debouncer calling fire once name has been
+// quiet for the quiet period.
+func newDebouncer(quiet time.Duration, fire func(name string)) *debouncer {
+	return &debouncer{
+		quiet:  quiet,
+		fire:   fire,
+		timers: make(map[string]*time.Timer),
+		hashes: make(map[string]string),
+	}
+}
+
+// isSaveEvent reports whether event may leave a new version of its
+// file in place: a write, a create (which is how a file renamed into
+// place arrives), or the rename or removal of the old version that
+// editors do just before writing the new one.  Touching a go file,
+// which only changes its attributes, counts too, so that touching it
+// again retries a failed request.
+func isSaveEvent(event fsnotify.Event) bool {
+	if event.Op&fsnotify.Chmod != 0 && isGoFile(event.Name) {
+		return true
+	}
+	return event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename|fsnotify.Remove) != 0
+}
+
+// Event notes an event for name, restarting its quiet period.
+func (d *debouncer) Event(name string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.stopped {
+		return
+	}
+	if timer, ok := d.timers[name]; ok {
+		timer.Reset(d.quiet)
+		return
+	}
+	d.timers[name] = time.AfterFunc(d.quiet, func() { d.settled(name) })
+}
+
+// Stop cancels the quiet periods under way and ignores further events,
+// so that fire is no longer called.
+func (d *debouncer) Stop() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.stopped = true
+	for name, timer := range d.timers {
+		timer.Stop()
+		delete(d.timers, name)
+	}
+}
+
+// Forget drops what is known of the files under dir, which has been
+// removed or renamed away, so that a file later saved there fires even
+// if its content is what it was before.
+func (d *debouncer) Forget(dir string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for name, timer := range d.timers {
+		if tree.IsWithin(dir, name) {
+			timer.Stop()
+			delete(d.timers, name)
+		}
+	}
+	for name := range d.hashes {
+		if tree.IsWithin(dir, name) {
+			delete(d.hashes, name)
+		}
+	}
+}
+
+// Rearm forgets the content name was last acted on with, so that its
+// next event fires even if the content is unchanged, as when retrying
+// a failed request.
+func (d *debouncer) Rearm(name string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.hashes, name)
+}
+
+// settled is called once name has been quiet for the quiet period.
+func (d *debouncer) settled(name string) {
+	d.mu.Lock()
+	if d.stopped {
+		d.mu.Unlock()
+		return
+	}
+	delete(d.timers, name)
+	hash, err := tree.FileHash(name)
+	if err != nil {
+		// removed, or renamed away for good
+		if os.IsNotExist(err) {
+			delete(d.hashes, name)
+		}
+		d.mu.Unlock()
+		return
+	}
+	if d.hashes[name] == hash {
+		d.mu.Unlock()
+		return
+	}
+	d.hashes[name] = hash
+	d.mu.Unlock()
+
+	d.fire(name)
+}
+
+// Prime records the current content of the files under dir for which
+// match returns true, so that saving them unchanged does nothing.
+// Hidden directories and those matched by ignore, relative to
+// rootPath, are skipped, and entries that can't be read are logged.
+func (d *debouncer) Prime(dir, rootPath string, ignore *tree.IgnoreList, match func(name string) bool) {
+	filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			log.Println("Error priming:", err)
+			return nil
+		}
+		if fi.IsDir() {
+			if p != dir && (strings.HasPrefix(fi.Name(), ".") || ignore.IgnoredPath(rootPath, p, true)) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !match(p) {
+			return nil
+		}
+		hash, err := tree.FileHash(p)
+		if err != nil {
+			log.Println("Error priming:", err)
+			return nil
+		}
+		d.mu.Lock()
+		d.hashes[p] = hash
+		d.mu.Unlock()
+		return nil
+	})
+}
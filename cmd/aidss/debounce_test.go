@@ -0,0 +1,161 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+
+	"github.com/stevegt/aidss/tree"
+)
+
+func TestDebouncer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_debounce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	quiet := 20 * time.Millisecond
+	fired := make(chan string, 10)
+	d := newDebouncer(quiet, func(name string) { fired <- name })
+	name := filepath.Join(dir, tree.PromptFn)
+	write := func(content string) {
+		err := ioutil.WriteFile(name, []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d.Event(name)
+	}
+	expectFired := func(n int) {
+		t.Helper()
+		time.Sleep(5 * quiet)
+		if len(fired) != n {
+			t.Errorf("Expected %d calls, got %d", n, len(fired))
+		}
+		for len(fired) > 0 {
+			<-fired
+		}
+	}
+
+	// A save in several writes fires once
+	write("Hello")
+	write("Hello, world")
+	write("Hello, world.")
+	expectFired(1)
+
+	// Saving unchanged content doesn't fire
+	write("Hello, world.")
+	expectFired(0)
+
+	// Write to a temporary file, rename the old version away and the
+	// new one into place, as Vim and JetBrains IDEs do
+	tmp := name + "___jb_tmp___"
+	err = ioutil.WriteFile(tmp, []byte("Goodbye"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Rename(name, name+"~")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Event(name)
+	err = os.Rename(tmp, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Event(name)
+	expectFired(1)
+
+	// A file that is removed doesn't fire
+	err = os.Remove(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Event(name)
+	expectFired(0)
+
+	// Files seen by Prime only fire once changed
+	write("Primed")
+	expectFired(1)
+	d = newDebouncer(quiet, func(name string) { fired <- name })
+	d.Prime(dir, dir, &tree.IgnoreList{}, watchedFile)
+	write("Primed")
+	expectFired(0)
+	write("Changed")
+	expectFired(1)
+
+	// A file under a forgotten directory fires even if unchanged
+	d.Forget(dir)
+	write("Changed")
+	expectFired(1)
+
+	// Nothing fires once stopped, even a quiet period under way
+	write("Pending")
+	d.Stop()
+	write("Stopped")
+	expectFired(0)
+}
+
+func TestPrimeSkipsIgnored(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_prime")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	err = ioutil.WriteFile(filepath.Join(dir, tree.GitIgnoreFn), []byte("node_modules/\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, sub := range []string{"node", "node_modules", ".hidden"} {
+		name := filepath.Join(dir, sub, tree.PromptFn)
+		err = os.MkdirAll(filepath.Dir(name), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(name, []byte("Question"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	ignore, err := tree.LoadIgnoreRules(tree.OS, dir, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := newDebouncer(time.Millisecond, nil)
+	d.Prime(dir, dir, ignore, watchedFile)
+	if _, ok := d.hashes[names[0]]; !ok {
+		t.Errorf("Expected %s to be primed", names[0])
+	}
+	for _, name := range names[1:] {
+		if _, ok := d.hashes[name]; ok {
+			t.Errorf("Expected %s to be skipped", name)
+		}
+	}
+}
+
+func TestIsSaveEvent(t *testing.T) {
+	cases := []struct {
+		name     string
+		op       fsnotify.Op
+		expected bool
+	}{
+		{tree.PromptFn, fsnotify.Write, true},
+		{tree.PromptFn, fsnotify.Create, true},
+		{tree.PromptFn, fsnotify.Rename, true},
+		{tree.PromptFn, fsnotify.Remove, true},
+		{tree.PromptFn, fsnotify.Chmod, false},
+		{"go", fsnotify.Chmod, true},
+	}
+	for _, c := range cases {
+		if got := isSaveEvent(fsnotify.Event{Name: c.name, Op: c.op}); got != c.expected {
+			t.Errorf("%s %v: expected %v, got %v", c.name, c.op, c.expected, got)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/stevegt/aidss/tree"
+)
+
+// defaultWorkers is the number of jobs run at once by default.
+const defaultWorkers = 4
+
+// job is a unit of work for the daemon, such as answering a prompt or
+// extracting a PDF's text.
+type job struct {
+	key  string // the file the job is for; queued jobs are unique by key
+	node string // the node the job works on; jobs on a node run one at a time
+	run  func()
+}
+
+// jobQueue runs jobs on a bounded pool of workers.  Jobs on different
+// branches run concurrently, while a job waits for the jobs added
+// before it on its node or the node's ancestors, whose responses it
+// may build on.  A job is dropped if one for the same file is already
+// waiting, since that one will see the file's latest content anyway.
+type jobQueue struct {
+	statusPath string // file to write the queue's state to, or ""
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	waiting []*job
+	keys    map[string]bool // keys of waiting jobs
+	running []*job
+	closed  bool
+	wg      sync.WaitGroup
+}
+
+// newJobQueue starts a queue with the given number of workers.  If
+// statusPath isn't "", the queue's state is written to it whenever it
+// changes.
+func newJobQueue(workers int, statusPath string) *jobQueue {
+	if workers < 1 {
+		workers = 1
+	}
+	q := &jobQueue{
+		statusPath: statusPath,
+		keys:       make(map[string]bool),
+	}
+	q.cond = sync.NewCond(&q.mu)
+	for i := 0; i < workers; i++ {
+		q.wg.Add(1)
+		go q.worker()
+	}
+	return q
+}
+
+// Add queues run as the job for the file key on node.  It returns
+// false if the job was dropped, because one for the same file is
+// already waiting or the queue is closed.
+func (q *jobQueue) Add(key, node string, run func()) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return false
+	}
+	if q.keys[key] {
+		log.Printf("Already queued: %s (%s)", key, q.depth())
+		return false
+	}
+	q.waiting = append(q.waiting, &job{key: key, node: node, run: run})
+	q.keys[key] = true
+	q.cond.Signal()
+	log.Printf("Queued: %s (%s)", key, q.depth())
+	q.changed()
+	return true
+}
+
+// Depth returns the number of jobs waiting and running.
+func (q *jobQueue) Depth() (waiting, running int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.waiting), len(q.running)
+}
+
+// Close stops the queue taking new jobs and waits for the workers to
+// finish the jobs already queued.
+func (q *jobQueue) Close() {
+	q.mu.Lock()
+	q.closed = true
+	q.cond.Broadcast()
+	q.mu.Unlock()
+	q.wg.Wait()
+}
+
+// Stop stops the queue taking new jobs and drops the jobs waiting,
+// returning their keys.  The jobs running carry on.
+func (q *jobQueue) Stop() []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var dropped []string
+	for _, j := range q.waiting {
+		dropped = append(dropped, j.key)
+	}
+	q.waiting = nil
+	q.keys = make(map[string]bool)
+	q.closed = true
+	q.cond.Broadcast()
+	q.changed()
+	return dropped
+}
+
+// Wait waits up to timeout for the workers of a closed or stopped
+// queue to finish, reporting whether they did.
+func (q *jobQueue) Wait(timeout time.Duration) bool {
+	done := make(chan bool)
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// worker runs jobs until the queue is closed and empty.
+func (q *jobQueue) worker() {
+	defer q.wg.Done()
+	for {
+		q.mu.Lock()
+		j := q.next()
+		for j == nil {
+			if q.closed && len(q.waiting) == 0 {
+				q.mu.Unlock()
+				return
+			}
+			q.cond.Wait()
+			j = q.next()
+		}
+		q.changed()
+		q.mu.Unlock()
+
+		j.run()
+
+		q.mu.Lock()
+		for i, r := range q.running {
+			if r == j {
+				q.running = append(q.running[:i], q.running[i+1:]...)
+				break
+			}
+		}
+		log.Printf("Finished: %s (%s)", j.key, q.depth())
+		q.changed()
+		q.cond.Broadcast()
+		q.mu.Unlock()
+	}
+}
+
+// next takes the first waiting job that isn't waiting on another off
+// the queue and marks it running, or returns nil if there is none.
+// Callers must hold q.mu.
+func (q *jobQueue) next() *job {
+	for i, j := range q.waiting {
+		if dependsOn(j, q.running) || dependsOn(j, q.waiting[:i]) {
+			continue
+		}
+		q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+		delete(q.keys, j.key)
+		q.running = append(q.running, j)
+		return j
+	}
+	return nil
+}
+
+// dependsOn reports whether any of jobs is on j's node or one of its
+// ancestors.
+func dependsOn(j *job, jobs []*job) bool {
+	for _, other := range jobs {
+		if tree.IsWithin(other.node, j.node) {
+			return true
+		}
+	}
+	return false
+}
+
+// depth describes the queue's depth for logs.  Callers must hold q.mu.
+func (q *jobQueue) depth() string {
+	return fmt.Sprintf("%d waiting, %d running", len(q.waiting), len(q.running))
+}
+
+// changed writes the queue's state to the status file, if any.
+// Callers must hold q.mu.
+func (q *jobQueue) changed() {
+	if q.statusPath == "" {
+		return
+	}
+	var builder strings.Builder
+	builder.WriteString(q.depth() + "\n")
+	var running []string
+	for _, j := range q.running {
+		running = append(running, j.key)
+	}
+	sort.Strings(running)
+	for _, key := range running {
+		builder.WriteString("running: " + key + "\n")
+	}
+	for _, j := range q.waiting {
+		builder.WriteString("waiting: " + j.key + "\n")
+	}
+	err := ioutil.WriteFile(q.statusPath, []byte(builder.String()), 0644)
+	if err != nil {
+		log.Println("Error writing queue status:", err)
+	}
+}
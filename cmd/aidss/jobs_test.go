@@ -0,0 +1,158 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stevegt/aidss/tree"
+)
+
+func TestJobQueueConcurrency(t *testing.T) {
+	q := newJobQueue(4, "")
+
+	// Jobs on different nodes run at the same time: each waits for the
+	// other to start
+	var started sync.WaitGroup
+	started.Add(2)
+	both := make(chan bool, 2)
+	for _, node := range []string{"a", "b"} {
+		q.Add(node+"/prompt.txt", node, func() {
+			started.Done()
+			done := make(chan bool)
+			go func() { started.Wait(); close(done) }()
+			select {
+			case <-done:
+				both <- true
+			case <-time.After(time.Second):
+				both <- false
+			}
+		})
+	}
+	for i := 0; i < 2; i++ {
+		if !<-both {
+			t.Fatal("Expected jobs on different nodes to run concurrently")
+		}
+	}
+
+	// Jobs on the same node run one at a time, in order
+	var mu sync.Mutex
+	var order []int
+	active, maxActive := 0, 0
+	for i := 0; i < 5; i++ {
+		i := i
+		q.Add(filepath.Join("c", string(rune('a'+i))+".pdf"), "c", func() {
+			mu.Lock()
+			active++
+			if active > maxActive {
+				maxActive = active
+			}
+			mu.Unlock()
+			time.Sleep(5 * time.Millisecond)
+			mu.Lock()
+			active--
+			order = append(order, i)
+			mu.Unlock()
+		})
+	}
+	q.Close()
+	if maxActive != 1 {
+		t.Errorf("Expected jobs on one node to run one at a time, got %d at once", maxActive)
+	}
+	for i, n := range order {
+		if n != i {
+			t.Errorf("Expected jobs in order, got %v", order)
+			break
+		}
+	}
+
+	if q.Add("d/prompt.txt", "d", func() {}) {
+		t.Errorf("Expected a closed queue to drop jobs")
+	}
+}
+
+func TestJobQueueDedup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_jobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	statusPath := filepath.Join(dir, queueFn)
+
+	q := newJobQueue(2, statusPath)
+	release := make(chan bool)
+	running := make(chan bool)
+	runs := 0
+	q.Add("a/prompt.txt", "a", func() {
+		running <- true
+		<-release
+		runs++
+	})
+	<-running
+
+	// While the first job runs, a second save queues one more job, and
+	// further saves are dropped as that job will see them
+	if !q.Add("a/prompt.txt", "a", func() { runs++ }) {
+		t.Errorf("Expected a job to be queued while the first runs")
+	}
+	if q.Add("a/prompt.txt", "a", func() { runs++ }) {
+		t.Errorf("Expected a duplicate job to be dropped")
+	}
+	if waiting, active := q.Depth(); waiting != 1 || active != 1 {
+		t.Errorf("Expected 1 waiting and 1 running, got %d and %d", waiting, active)
+	}
+	data, err := ioutil.ReadFile(statusPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"1 waiting, 1 running", "running: a/prompt.txt", "waiting: a/prompt.txt"} {
+		if !strings.Contains(string(data), s) {
+			t.Errorf("Expected queue status to contain %q, got %q", s, data)
+		}
+	}
+
+	close(release)
+	q.Close()
+	if runs != 2 {
+		t.Errorf("Expected 2 runs, got %d", runs)
+	}
+	data, err = ioutil.ReadFile(statusPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "0 waiting, 0 running\n" {
+		t.Errorf("Expected an empty queue, got %q", data)
+	}
+}
+
+func TestJobQueueAncestors(t *testing.T) {
+	q := newJobQueue(4, "")
+
+	// A child node's job waits for its parent's, while another branch
+	// goes ahead
+	var mu sync.Mutex
+	var order []string
+	record := func(node string) func() {
+		return func() {
+			if node == "a" {
+				time.Sleep(20 * time.Millisecond)
+			}
+			mu.Lock()
+			order = append(order, node)
+			mu.Unlock()
+		}
+	}
+	for _, node := range []string{"a", filepath.Join("a", "b"), "c"} {
+		q.Add(filepath.Join(node, tree.PromptFn), node, record(node))
+	}
+	q.Close()
+
+	want := []string{"c", "a", filepath.Join("a", "b")}
+	if strings.Join(order, " ") != strings.Join(want, " ") {
+		t.Errorf("Expected %v, got %v", want, order)
+	}
+}
@@ -1,41 +1,36 @@
 package main
 
 import (
+	"bytes"
 	"context"
-	"encoding/json"
-	"encoding/xml"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
-	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/fsnotify/fsnotify"
-	"github.com/google/uuid"
 	"github.com/spf13/cobra"
 	"rsc.io/pdf"
 
 	"github.com/stevegt/aidss/llm"
+	"github.com/stevegt/aidss/tree"
 	. "github.com/stevegt/goadapt"
 )
 
-var (
-	mutex sync.Mutex // To handle concurrent access
-
-	promptFn     = "prompt.txt"
-	promptFullFn = "prompt-full.txt"
-	responseFn   = "response.txt"
+// Files the daemon keeps in a node, or in the watch path, alongside the
+// tree's own
+const (
+	statusFn     = "status"
+	queueFn      = "queue.txt"
+	promptHashFn = "prompt.sha256"
 )
 
-type Prompt struct {
-	InFiles    []string
-	OutFiles   []string
-	SysMsg     string
-	PromptText string
-}
-
 func main() {
 	// Initialize and register providers
 	llm.RegisterProviders()
@@ -50,18 +45,84 @@ func main() {
 		Run: func(cmd *cobra.Command, args []string) {
 			watchPath, err := cmd.Flags().GetString("path")
 			Ck(err)
+			rootPath, err := cmd.Flags().GetString("root")
+			Ck(err)
+			if rootPath == "" {
+				rootPath, err = tree.ProjectRoot(watchPath)
+				Ck(err)
+			}
 			modelName, err := cmd.Flags().GetString("model")
 			Ck(err)
-			startDaemon(watchPath, modelName)
+			trigger, err := cmd.Flags().GetString("trigger")
+			Ck(err)
+			err = checkTriggerMode(trigger)
+			if err != nil {
+				log.Fatal(err)
+			}
+			workers, err := cmd.Flags().GetInt("jobs")
+			Ck(err)
+			noCatchup, err := cmd.Flags().GetBool("no-catchup")
+			Ck(err)
+			grace, err := cmd.Flags().GetDuration("grace")
+			Ck(err)
+			watchBackend, err := cmd.Flags().GetString("watcher")
+			Ck(err)
+			pollInterval, err := cmd.Flags().GetDuration("poll-interval")
+			Ck(err)
+			os.Exit(startDaemon(watchPath, rootPath, modelName, trigger, watchBackend, pollInterval, workers, !noCatchup, grace))
 		},
 	}
 
+	// Show what would be sent for a node without sending it
+	previewCmd := &cobra.Command{
+		Use:   "preview <node>",
+		Short: "Print the messages that would be sent for a node, with token counts and estimated cost",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			watchPath, err := cmd.Flags().GetString("path")
+			Ck(err)
+			rootPath, err := cmd.Flags().GetString("root")
+			Ck(err)
+			if rootPath == "" {
+				rootPath, err = tree.ProjectRoot(watchPath)
+				Ck(err)
+			}
+			modelName, err := cmd.Flags().GetString("model")
+			Ck(err)
+			// Nothing is sent, so no client, and no API key, is needed
+			model, err := llm.LookupModel(modelName)
+			if err != nil {
+				log.Fatal(err)
+			}
+			watchPath, err = filepath.Abs(watchPath)
+			Ck(err)
+			rootPath, err = filepath.Abs(rootPath)
+			Ck(err)
+			path, err := previewPath(args[0], watchPath)
+			if err != nil {
+				log.Fatal(err)
+			}
+			err = tree.New(tree.OS, watchPath, rootPath).Node(path).Preview(os.Stdout, model)
+			if err != nil {
+				log.Fatal(err)
+			}
+		},
+	}
+	rootCmd.AddCommand(previewCmd)
+
 	// Make sure usage includes model names
 	modelUsage := fmt.Sprintf("Model to use (%s)", strings.Join(models, ", "))
 
 	// Define flags
-	rootCmd.Flags().StringP("path", "p", ".", "Path to watch")
-	rootCmd.Flags().StringP("model", "m", models[0], modelUsage)
+	rootCmd.PersistentFlags().StringP("path", "p", ".", "Path to watch")
+	rootCmd.PersistentFlags().StringP("root", "r", "", "Project root that In and Out files must stay within (default: parent of --path)")
+	rootCmd.PersistentFlags().StringP("model", "m", models[0], modelUsage)
+	rootCmd.Flags().IntP("jobs", "j", defaultWorkers, "Number of prompts and attachments to work on at once")
+	rootCmd.Flags().StringP("watcher", "w", tree.WatchAuto, fmt.Sprintf("How to watch for changes (%s); auto uses fsnotify and falls back to polling at the inotify limits", strings.Join(tree.WatchBackends, ", ")))
+	rootCmd.Flags().Duration("poll-interval", tree.DefaultPollInterval, "How often the polling watcher scans the tree")
+	rootCmd.Flags().Duration("grace", defaultGrace, "How long to let running requests finish on shutdown before cancelling them")
+	rootCmd.Flags().Bool("no-catchup", false, "Don't answer prompts or extract PDFs changed while the daemon was down")
+	rootCmd.Flags().StringP("trigger", "t", triggerSave, fmt.Sprintf("What submits a prompt (%s)", strings.Join(triggerModes, ", ")))
 
 	// Execute the root command
 	if err := rootCmd.Execute(); err != nil {
@@ -70,54 +131,133 @@ func main() {
 }
 
 // startDaemon starts the decision tool daemon. The daemon watches the file system for changes
-// and responds to user messages and attachments.
-func startDaemon(watchPath string, modelName string) {
+// and responds to user messages and attachments.  In and Out files
+// named in prompts are confined to rootPath.  trigger is the trigger
+// mode, which decides which saves submit a prompt, and workers the
+// number of jobs run at once.  watchBackend is the watcher backend,
+// polling every pollInterval if it polls.  If catchup is true, prompts and PDFs
+// changed while the daemon was down are queued on startup.
+// The daemon runs until SIGINT or SIGTERM, then gives the jobs running
+// up to grace to finish and returns the exit status; SIGHUP reloads
+// its configuration.
+func startDaemon(watchPath, rootPath, modelName, trigger, watchBackend string, pollInterval time.Duration, workers int, catchup bool, grace time.Duration) int {
 	var err error
 
-	// Set up the LLM client based on the model name
-	client, err := llm.NewClient(modelName)
+	// The tree is kept on the filesystem
+	store := tree.NewOSStore(watchBackend, pollInterval)
+	decisionTree := tree.New(store, watchPath, rootPath)
+
+	// The LLM client and the ignore rules are reloaded on SIGHUP
+	var config atomic.Pointer[daemonConfig]
+	cfg, err := loadDaemonConfig(store, watchPath, rootPath, modelName)
 	if err != nil {
 		log.Fatal(err)
 	}
+	config.Store(cfg)
+
+	// Cancelled to abandon the requests still running at shutdown
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
 	// Start the file watcher
-	watcher, err := fsnotify.NewWatcher()
+	watcher, err := store.Watch()
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer watcher.Close()
+	watches := newWatchTree(watcher, rootPath)
+
+	// Work on different nodes runs concurrently, on a bounded number
+	// of workers
+	queue := newJobQueue(workers, filepath.Join(watchPath, queueFn))
+
+	// queuePrompt queues answering the node at path, if its prompt
+	// has been submitted, and queues it again if the prompt changes
+	// while it is answered.  If the request fails, the next save of
+	// the file key, even unchanged, retries it.
+	var queuePrompt func(key, path string)
+	var debounce *debouncer
+	queuePrompt = func(key, path string) {
+		ok, err := triggered(path, trigger)
+		if err != nil {
+			log.Println("Error checking trigger:", err)
+			return
+		}
+		if !ok {
+			log.Println("Not submitted yet:", path)
+			return
+		}
+		engine := tree.NewEngine(decisionTree, config.Load().client)
+		if !queue.Add(key, path, func() {
+			switch answerNode(ctx, engine, path, trigger) {
+			case answerChanged:
+				queuePrompt(key, path)
+			case answerFailed:
+				debounce.Rearm(key)
+			}
+		}) {
+			return
+		}
+		err = saveNodeStatus(path, nodeQueued)
+		if err != nil {
+			log.Println("Error saving status:", err)
+		}
+	}
 
-	done := make(chan bool)
+	// Act on prompts and PDFs once they have settled, and only if
+	// their content changed
+	debounce = newDebouncer(quietPeriod, func(name string) {
+		if path, ok := triggerNode(name, trigger); ok {
+			log.Println("Detected change in:", name)
+			queuePrompt(name, path)
+		}
+		if filepath.Ext(name) == ".pdf" {
+			log.Println("Detected PDF attachment:", name)
+			queue.Add(name, filepath.Dir(name), func() {
+				handlePDFAttachment(name, extractTextFromPDF)
+			})
+		}
+	})
 
 	// Handle file system events
 	go func() {
 		for {
 			select {
-			case event, ok := <-watcher.Events:
+			case event, ok := <-watcher.Events():
 				if !ok {
 					// Watcher has been closed
 					return
 				}
-				if event.Op&fsnotify.Write == fsnotify.Write {
-					// handle file write events
-					if filepath.Base(event.Name) == promptFn {
-						log.Println("Detected change in:", event.Name)
-						handleUserMessage(filepath.Dir(event.Name), client, watchPath)
-					}
-					if filepath.Ext(event.Name) == ".pdf" {
-						log.Println("Detected PDF attachment:", event.Name)
-						handlePDFAttachment(event.Name, extractTextFromPDF)
+				if isSaveEvent(event) && watchedFile(event.Name) {
+					debounce.Event(event.Name)
+				}
+				if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+					// A directory removed or renamed away takes its
+					// subtree with it; one renamed in arrives as a Create
+					if removed := watches.Remove(event.Name); len(removed) > 0 {
+						debounce.Forget(event.Name)
+						log.Printf("Stopped watching %d directories under: %s", len(removed), event.Name)
 					}
 				}
 				if event.Op&fsnotify.Create == fsnotify.Create {
-					// If a new directory is created, add it to the watcher
-					fi, err := os.Stat(event.Name)
-					if err == nil && fi.IsDir() {
-						watcher.Add(event.Name)
-						log.Println("Added new directory to watcher:", event.Name)
+					// A new directory may arrive with its contents,
+					// which bring no events of their own
+					fi, err := store.Stat(event.Name)
+					ignore := config.Load().ignore
+					if err == nil && fi.IsDir() && !ignore.IgnoredPath(rootPath, event.Name, true) {
+						added, err := watches.Add(event.Name, ignore)
+						if err != nil {
+							log.Println("Error watching new directory:", err)
+						}
+						if len(added) > 0 {
+							log.Printf("Added %d new directories to watcher under: %s", len(added), event.Name)
+						}
+						for _, name := range pendingFiles(added) {
+							debounce.Event(name)
+						}
 					}
 				}
-			case err, ok := <-watcher.Errors:
+			case err, ok := <-watcher.Errors():
 				if !ok {
 					return
 				}
@@ -126,311 +266,145 @@ func startDaemon(watchPath string, modelName string) {
 		}
 	}()
 
+	// Handle signals from here on, so that none is missed once
+	// watching has started
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
 	// Watch the root path
-	err = addWatcherRecursive(watcher, watchPath)
+	_, err = watches.Add(watchPath, cfg.ignore)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	log.Println("Started watching:", watchPath)
-	<-done
-}
-
-// addWatcherRecursive recursively adds a directory and its subdirectories to the watcher
-func addWatcherRecursive(watcher *fsnotify.Watcher, path string) error {
-	err := watcher.Add(path)
-	if err != nil {
-		return err
-	}
-
-	files, err := ioutil.ReadDir(path)
-	if err != nil {
-		return err
-	}
+	debounce.Prime(watchPath, rootPath, cfg.ignore, watchedFile)
 
-	for _, file := range files {
-		if file.IsDir() {
-			err = addWatcherRecursive(watcher, filepath.Join(path, file.Name()))
-			if err != nil {
-				return err
-			}
+	// Catch up on prompts and PDFs saved while the daemon was down
+	if catchup {
+		prompts, pdfs, err := staleWork(watchPath, rootPath, cfg.ignore)
+		if err != nil {
+			log.Fatal(err)
 		}
-	}
-
-	return nil
-}
-
-// parsePromptFile parses the prompt file and returns a Prompt struct
-func parsePromptFile(filename string) (*Prompt, error) {
-	data, err := ioutil.ReadFile(filename)
-	if err != nil {
-		return nil, err
-	}
-
-	content := string(data)
-	prompt := &Prompt{}
-
-	// Split headers and prompt text
-	parts := strings.SplitN(content, "\n\n", 2)
-	if len(parts) != 2 {
-		return nil, fmt.Errorf("Invalid prompt file format")
-	}
-
-	headerText := parts[0]
-	prompt.PromptText = parts[1]
-
-	headers := make(map[string]string)
-	lines := strings.Split(headerText, "\n")
-	var currentHeader string
-	var currentValue strings.Builder
-
-	// collect header text, unwrap continuation lines
-	for _, line := range lines {
-		if strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t") {
-			// continuation line
-			currentValue.WriteString(Spf(" %s", strings.TrimSpace(line)))
-			headers[currentHeader] = currentValue.String()
-			continue
+		log.Printf("Catching up on %d prompts and %d PDFs", len(prompts), len(pdfs))
+		// PDFs first, so prompts see their text
+		for _, pdfPath := range pdfs {
+			pdfPath := pdfPath
+			queue.Add(pdfPath, filepath.Dir(pdfPath), func() {
+				handlePDFAttachment(pdfPath, extractTextFromPDF)
+			})
 		}
-		// New header line
-		// get header label
-		colonIndex := strings.Index(line, ":")
-		if colonIndex == -1 {
-			return nil, fmt.Errorf("Header line without colon")
+		for _, path := range prompts {
+			queuePrompt(filepath.Join(path, tree.PromptFn), path)
 		}
-		currentHeader = strings.TrimSpace(line[:colonIndex])
-		value := strings.TrimSpace(line[colonIndex+1:])
-		currentValue.Reset()
-		currentValue.WriteString(value)
-		headers[currentHeader] = currentValue.String()
 	}
 
-	// Now process headers
-	for key, value := range headers {
-		switch key {
-		case "In":
-			prompt.InFiles = append(prompt.InFiles, strings.Fields(value)...)
-		case "Out":
-			prompt.OutFiles = append(prompt.OutFiles, strings.Fields(value)...)
-		case "Sysmsg":
-			prompt.SysMsg = value
-		default:
-			// Ignore unknown headers
+	log.Printf("Started watching: %s (%d directories) project root: %s", watchPath, len(watches.Nodes()), rootPath)
+	for sig := range signals {
+		if sig != syscall.SIGHUP {
+			log.Printf("Received %v, shutting down", sig)
+			break
+		}
+		log.Println("Received SIGHUP, reloading configuration")
+		cfg, err := loadDaemonConfig(store, watchPath, rootPath, modelName)
+		if err != nil {
+			log.Println("Error reloading configuration, keeping the old one:", err)
+			continue
+		}
+		config.Store(cfg)
+		// Directories no longer ignored are watched from now on
+		_, err = watches.Add(watchPath, cfg.ignore)
+		if err != nil {
+			log.Println("Error watching:", err)
 		}
 	}
 
-	return prompt, nil
+	// Stop new work before waiting for the old
+	watcher.Close()
+	debounce.Stop()
+	return shutdown(queue, cancel, grace)
 }
 
-// handleUserMessage handles a user message by generating a response from the language model
-func handleUserMessage(path string, client llm.Client, watchPath string) {
-	mutex.Lock()
-	defer mutex.Unlock()
-
-	messagePath := filepath.Join(path, promptFn)
-	prompt, err := parsePromptFile(messagePath)
-	if err != nil {
-		log.Println("Error parsing prompt file:", err)
-		return
-	}
-
-	// Build context messages
-	contextMessages := buildContextMessages(path, watchPath)
-
-	// Add system message if provided
-	if prompt.SysMsg != "" {
-		contextMessages = append(contextMessages, llm.Message{
-			Role:    llm.ChatMessageRoleSystem,
-			Content: prompt.SysMsg,
-		})
-	}
+// Outcomes of answerNode
+const (
+	answerSkipped = iota // not submitted, or withdrawn while queued
+	answerDone           // answered, and the trigger cleared
+	answerFailed         // the request failed; the prompt stays submitted
+	answerChanged        // answered, but the prompt changed meanwhile
+)
 
-	// Read and include contents of InFiles
-	inFilesContent, err := readInFilesContent(prompt.InFiles, path)
+// answerNode asks engine the prompt of the node at path if it has been
+// submitted in trigger mode and, if the prompt was answered, clears
+// the trigger and records the hash of the prompt as sent.  If prompt.txt was changed while
+// the request ran, the trigger is left for the new content, which the
+// caller should queue again.  The node's status file follows the
+// request from running to done or failed.
+func answerNode(ctx context.Context, engine *tree.Engine, path, trigger string) int {
+	ok, err := triggered(path, trigger)
 	if err != nil {
-		log.Println("Error reading In files:", err)
-		return
-	}
-
-	// Build the user message
-	userContent := Spf("%s\n\n", prompt.PromptText)
-	if len(inFilesContent) > 0 {
-		userContent += "The following files are attached:\n" + inFilesContent + "\n"
+		log.Println("Error checking trigger:", err)
+		return answerSkipped
 	}
-
-	// Append the new user message
-	contextMessages = append(contextMessages, llm.Message{
-		Role:    llm.ChatMessageRoleUser,
-		Content: userContent,
-	})
-
-	// Save the full prompt message to prompt-full.txt
-	err = saveFullPrompt(path, contextMessages)
-	if err != nil {
-		log.Println("Error saving full prompt:", err)
-		return
+	if !ok {
+		// withdrawn while it was queued
+		log.Println("Not submitted yet:", path)
+		err = clearNodeStatus(path)
+		if err != nil {
+			log.Println("Error clearing status:", err)
+		}
+		return answerSkipped
 	}
-
-	response, err := getLLMResponse(contextMessages, client)
+	err = saveNodeStatus(path, nodeRunning)
 	if err != nil {
-		log.Println("Error getting LLM response:", err)
-		return
+		log.Println("Error saving status:", err)
 	}
-
-	// Save the LLM response
-	responsePath := filepath.Join(path, responseFn)
-	err = ioutil.WriteFile(responsePath, []byte(response), 0644)
-	if err != nil {
-		log.Println("Error writing LLM response:", err)
+	// What is sent, to tell edits made meanwhile from the prompt
+	// answered
+	promptPath := filepath.Join(path, tree.PromptFn)
+	sent, err := ioutil.ReadFile(promptPath)
+	if err == nil {
+		err = engine.Ask(ctx, engine.Tree.Node(path))
 	}
-
-	log.Println("LLM response written to:", responsePath)
-
-	// Parse the LLM response for updated files
-	err = processLLMResponse(response, prompt.OutFiles, path)
 	if err != nil {
-		log.Println("Error processing LLM response:", err)
-	}
-}
-
-func readInFilesContent(inFiles []string, currentPath string) (string, error) {
-	var contentBuilder strings.Builder
-	for _, relPath := range inFiles {
-		absPath := filepath.Join(currentPath, relPath)
-		data, err := ioutil.ReadFile(absPath)
+		log.Println("Error:", err)
+		// leave the prompt, still submitted, to be retried at startup
+		err = saveNodeStatus(path, nodeFailed)
 		if err != nil {
-			return "", fmt.Errorf("error reading file %s: %v", absPath, err)
+			log.Println("Error saving status:", err)
 		}
-		contentBuilder.WriteString(fmt.Sprintf("<IN filename=\"%s\">\n%s\n</IN>\n", relPath, string(data)))
+		return answerFailed
 	}
-	return contentBuilder.String(), nil
-}
-
-func processLLMResponse(response string, outFiles []string, currentPath string) error {
-	// Wrap the response in a root element to make it valid XML
-	wrappedResponse := "<root>" + response + "</root>"
-
-	// Parse the XML
-	type OutFile struct {
-		Filename string `xml:"filename,attr"`
-		Content  string `xml:",innerxml"`
-	}
-	type Root struct {
-		OutFiles []OutFile `xml:"OUT"`
-	}
-
-	var root Root
-	err := xml.Unmarshal([]byte(wrappedResponse), &root)
+	err = saveNodeStatus(path, nodeDone)
 	if err != nil {
-		return fmt.Errorf("error parsing LLM response XML: %v", err)
+		log.Println("Error saving status:", err)
 	}
-
-	// Map of filename to content
-	outFileContents := make(map[string]string)
-	for _, outFile := range root.OutFiles {
-		outFileContents[outFile.Filename] = outFile.Content
-	}
-
-	// For each file in outFiles, check if we have content
-	for _, filename := range outFiles {
-		content, ok := outFileContents[filename]
-		if !ok {
-			log.Printf("Warning: Filename %s specified in Out: section but not found in LLM response", filename)
-			continue
-		}
-
-		// Write the content to a temporary file
-		tmpPath := filepath.Join(currentPath, filename+".tmp")
-		err := ioutil.WriteFile(tmpPath, []byte(content), 0644)
-		Ck(err)
-		// Rename the temporary file to the final filename
-		err = os.Rename(tmpPath, filepath.Join(currentPath, filename))
-		Ck(err)
-		log.Printf("Updated file written to: %s", filename)
-	}
-
-	// Warn if there are files in the LLM response not specified in OutFiles
-	outFilesSet := make(map[string]struct{})
-	for _, filename := range outFiles {
-		outFilesSet[filename] = struct{}{}
-	}
-	for filename := range outFileContents {
-		if _, ok := outFilesSet[filename]; !ok {
-			log.Printf("Warning: Filename %s found in LLM response but not specified in Out: section", filename)
-		}
-	}
-
-	return nil
-}
-
-// buildContextMessages builds a list of chat messages from the root to the current directory
-// to provide context to the language model
-func buildContextMessages(path string, watchPath string) []llm.Message {
-	var messages []llm.Message
-	var paths []string
-
-	// Collect paths from root to current directory
-	currentPath := path
-	for {
-		paths = append([]string{currentPath}, paths...)
-		if currentPath == watchPath {
-			// stop at the watch path
-			break
-		}
-		parentPath := filepath.Dir(currentPath)
-		if parentPath == currentPath {
-			// stop at the filesystem root
-			break
-		}
-		currentPath = parentPath
-	}
-
-	// Build messages from collected paths
-	for _, p := range paths {
-		if content, err := ioutil.ReadFile(filepath.Join(p, promptFullFn)); err == nil {
-			messages = append(messages, llm.Message{
-				Role:    llm.ChatMessageRoleUser,
-				Content: string(content),
-			})
-		}
-		if content, err := ioutil.ReadFile(filepath.Join(p, responseFn)); err == nil {
-			messages = append(messages, llm.Message{
-				Role:    llm.ChatMessageRoleAssistant,
-				Content: string(content),
-			})
+	current, err := ioutil.ReadFile(promptPath)
+	if err != nil || !bytes.Equal(current, sent) {
+		log.Println("Prompt changed while it was answered:", path)
+		err = savePromptHash(path, sent)
+		if err != nil {
+			log.Println("Error saving prompt hash:", err)
 		}
+		return answerChanged
 	}
-
-	return messages
-}
-
-// saveFullPrompt saves the full prompt message to prompt-full.txt
-func saveFullPrompt(path string, messages []llm.Message) error {
-	var builder strings.Builder
-	for _, msg := range messages {
-		builder.WriteString(fmt.Sprintf("%s: %s\n", strings.Title(msg.Role), msg.Content))
+	answered, err := clearTrigger(path, trigger, sent)
+	if err != nil {
+		log.Println("Error clearing trigger:", err)
 	}
-	fullPromptPath := filepath.Join(path, promptFullFn)
-	err := ioutil.WriteFile(fullPromptPath, []byte(builder.String()), 0644)
+	// the prompt as sent, less its trigger
+	err = savePromptHash(path, answered)
 	if err != nil {
-		return err
+		log.Println("Error saving prompt hash:", err)
 	}
-	return nil
+	return answerDone
 }
 
-func getLLMResponse(messages []llm.Message, client llm.Client) (string, error) {
-	ctx := context.Background()
-	response, err := client.GenerateResponse(ctx, messages)
-	if err != nil {
-		return "", err
-	}
-	return response, nil
+// watchedFile reports whether changes to the named file are acted on.
+func watchedFile(name string) bool {
+	return filepath.Base(name) == tree.PromptFn || isGoFile(name) || filepath.Ext(name) == ".pdf"
 }
 
 func handlePDFAttachment(pdfPath string, extractTextFunc func(string) (string, error)) {
-	mutex.Lock()
-	defer mutex.Unlock()
-
 	text, err := extractTextFunc(pdfPath)
 	if err != nil {
 		log.Println("Error extracting text from PDF:", err)
@@ -456,6 +430,11 @@ func extractTextFromPDF(pdfPath string) (string, error) {
 	var text strings.Builder
 	numPages := r.NumPage()
 	for i := 1; i <= numPages; i++ {
+		if i > 1 {
+			// A form feed separates pages, as in pdftotext output, so
+			// that retrieved excerpts can cite their page
+			text.WriteString("\f")
+		}
 		p := r.Page(i)
 		if p.V.IsNull() {
 			continue
@@ -467,88 +446,3 @@ func extractTextFromPDF(pdfPath string) (string, error) {
 	}
 	return text.String(), nil
 }
-
-func createNewDecisionNode(parentPath, descriptor string) (string, error) {
-	// Sanitize the descriptor to remove invalid characters
-	sanitizedDescriptor := sanitizeDescriptor(descriptor)
-
-	// Generate a unique identifier
-	uuidStr := generateUUID()
-
-	// Combine to create the directory name
-	dirName := fmt.Sprintf("%s_%s", sanitizedDescriptor, uuidStr)
-	newPath := filepath.Join(parentPath, dirName)
-
-	err := os.Mkdir(newPath, 0755)
-	if err != nil {
-		return "", err
-	}
-	return newPath, nil
-}
-
-func sanitizeDescriptor(descriptor string) string {
-	// Replace spaces with underscores, remove special characters
-	descriptor = strings.ReplaceAll(descriptor, " ", "_")
-	descriptor = strings.ReplaceAll(descriptor, "/", "_")
-	descriptor = strings.ReplaceAll(descriptor, "\\", "_")
-	// Add more replacements as needed
-	return descriptor
-}
-
-func generateUUID() string {
-	// Generate a UUID
-	id := uuid.New()
-	return id.String()
-}
-
-func summarizePath(path string, client llm.Client, watchPath string) {
-	mutex.Lock()
-	defer mutex.Unlock()
-
-	messages := buildContextMessages(path, watchPath)
-	var textBuilder strings.Builder
-	for _, msg := range messages {
-		textBuilder.WriteString(msg.Role + ": " + msg.Content + "\n")
-	}
-	text := textBuilder.String()
-
-	summary, err := getSummary(text, client)
-	if err != nil {
-		log.Println("Error summarizing path:", err)
-		return
-	}
-
-	summaryPath := filepath.Join(path, "summary.txt")
-	err = ioutil.WriteFile(summaryPath, []byte(summary), 0644)
-	if err != nil {
-		log.Println("Error writing summary:", err)
-	} else {
-		log.Println("Summary written to:", summaryPath)
-	}
-}
-
-func getSummary(text string, client llm.Client) (string, error) {
-	summaryPrompt := fmt.Sprintf("Please provide a concise summary of the following conversation:\n\n%s", text)
-	messages := []llm.Message{
-		{
-			Role:    llm.ChatMessageRoleUser,
-			Content: summaryPrompt,
-		},
-	}
-	return getLLMResponse(messages, client)
-}
-
-func updateMetrics(path string, metrics map[string]interface{}) {
-	metricsPath := filepath.Join(path, "metrics.json")
-	data, err := json.MarshalIndent(metrics, "", "  ")
-	if err != nil {
-		log.Println("Error marshalling metrics:", err)
-		return
-	}
-	err = ioutil.WriteFile(metricsPath, data, 0644)
-	if err != nil {
-		log.Println("Error writing metrics:", err)
-	} else {
-		log.Println("Metrics updated at:", metricsPath)
-	}
-}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/stevegt/aidss/tree"
+)
+
+// The states of a node's request, as recorded in its status file.
+const (
+	nodeQueued  = "queued"
+	nodeRunning = "running"
+	nodeDone    = "done"
+	nodeFailed  = "failed"
+)
+
+// saveNodeStatus records state, with the time it was entered, in the
+// node's status file, so users can see what happened to their prompt
+// without reading the daemon's log.
+func saveNodeStatus(path, state string) error {
+	line := fmt.Sprintf("%s %s\n", state, time.Now().UTC().Format(time.RFC3339))
+	return tree.WriteFileAtomic(filepath.Join(path, statusFn), []byte(line))
+}
+
+// loadNodeStatus returns the state recorded in the node's status file
+// and when it was entered, or "" if there is no status file.
+func loadNodeStatus(path string) (string, time.Time, error) {
+	data, err := ioutil.ReadFile(filepath.Join(path, statusFn))
+	if os.IsNotExist(err) {
+		return "", time.Time{}, nil
+	}
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	state, stamp, _ := strings.Cut(strings.TrimSpace(string(data)), " ")
+	at, err := time.Parse(time.RFC3339, stamp)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("%s: %v", statusFn, err)
+	}
+	return state, at, nil
+}
+
+// clearNodeStatus removes the node's status file, for a prompt that
+// turned out not to be submitted after all.
+func clearNodeStatus(path string) error {
+	err := os.Remove(filepath.Join(path, statusFn))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
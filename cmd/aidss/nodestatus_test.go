@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stevegt/aidss/llm"
+	"github.com/stevegt/aidss/tree"
+)
+
+func TestNodeStatus(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	client, err := llm.NewClient("mock-model")
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine := tree.NewEngine(tree.New(tree.OS, dir, dir), client)
+
+	checkStatus := func(want string) {
+		t.Helper()
+		state, at, err := loadNodeStatus(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state != want {
+			t.Errorf("Expected status %q, got %q", want, state)
+		}
+		if want != "" && time.Since(at) > time.Minute {
+			t.Errorf("Expected a current timestamp, got %v", at)
+		}
+	}
+	checkStatus("")
+
+	// A malformed header fails the request, with the error in error.txt
+	promptPath := filepath.Join(dir, tree.PromptFn)
+	err = ioutil.WriteFile(promptPath, []byte("In: a.txt\nOops\n\nText"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	answerNode(context.Background(), engine, dir, triggerSave)
+	checkStatus(nodeFailed)
+	data, err := ioutil.ReadFile(filepath.Join(dir, tree.ErrorFn))
+	if err != nil || !strings.HasPrefix(string(data), "prompt.txt:2: ") {
+		t.Errorf("Expected the parse error in error.txt, got %q, %v", data, err)
+	}
+
+	// Answering clears the error
+	err = ioutil.WriteFile(promptPath, []byte("Text"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	answerNode(context.Background(), engine, dir, triggerSave)
+	checkStatus(nodeDone)
+	if _, err := os.Stat(filepath.Join(dir, tree.ErrorFn)); !os.IsNotExist(err) {
+		t.Errorf("Expected error.txt to be removed, got %v", err)
+	}
+
+	// A prompt withdrawn while queued loses its queued status
+	err = saveNodeStatus(dir, nodeQueued)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStatus(nodeQueued)
+	answerNode(context.Background(), engine, dir, triggerFile)
+	checkStatus("")
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/stevegt/aidss/tree"
+)
+
+// previewPath resolves the node argument of the preview command to a
+// path in the same form as watchPath: a path within watchPath is used
+// as is, and anything else is taken relative to watchPath.
+func previewPath(node, watchPath string) (string, error) {
+	absWatchPath, err := filepath.Abs(watchPath)
+	if err != nil {
+		return "", err
+	}
+	absNode, err := filepath.Abs(node)
+	if err != nil {
+		return "", err
+	}
+	if !tree.IsWithin(absWatchPath, absNode) {
+		absNode = filepath.Join(absWatchPath, node)
+		if filepath.IsAbs(node) || !tree.IsWithin(absWatchPath, absNode) {
+			return "", fmt.Errorf("%s is not within the watch path %s", node, watchPath)
+		}
+	}
+	return absNode, nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPreviewPath(t *testing.T) {
+	watchDir, err := ioutil.TempDir("", "test_preview_path")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(watchDir)
+
+	cases := []struct {
+		node     string
+		expected string
+	}{
+		{"a/b", filepath.Join(watchDir, "a", "b")},
+		{filepath.Join(watchDir, "a"), filepath.Join(watchDir, "a")},
+		{".", watchDir},
+		{"../outside", ""},
+	}
+	for _, c := range cases {
+		path, err := previewPath(c.node, watchDir)
+		if c.expected == "" {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %s", c.node, path)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: expected no error, got %v", c.node, err)
+			continue
+		}
+		if path != c.expected {
+			t.Errorf("%s: expected %s, got %s", c.node, c.expected, path)
+		}
+	}
+}
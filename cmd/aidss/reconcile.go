@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/stevegt/aidss/tree"
+)
+
+// staleWork walks the watch tree for work left over from while the
+// daemon was down: the nodes whose prompts are unanswered, and the
+// PDFs whose text hasn't been extracted, parents before children.
+// Directories matched by ignore, relative to rootPath, are skipped.
+func staleWork(watchPath, rootPath string, ignore *tree.IgnoreList) (prompts, pdfs []string, err error) {
+	err = filepath.Walk(watchPath, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if p != watchPath && ignore.IgnoredPath(rootPath, p, fi.IsDir()) {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if fi.IsDir() {
+			stale, err := promptStale(p)
+			if err != nil {
+				return err
+			}
+			if stale {
+				prompts = append(prompts, p)
+			}
+			return nil
+		}
+		if filepath.Ext(p) == ".pdf" {
+			stale, err := pdfStale(p)
+			if err != nil {
+				return err
+			}
+			if stale {
+				pdfs = append(pdfs, p)
+			}
+		}
+		return nil
+	})
+	return prompts, pdfs, err
+}
+
+// promptStale reports whether the node at path has a prompt that
+// hasn't been answered: its hash differs from the one recorded when it
+// was last answered or, for nodes without a recorded hash, it is newer
+// than the response.
+func promptStale(path string) (bool, error) {
+	promptPath := filepath.Join(path, tree.PromptFn)
+	promptFi, err := os.Stat(promptPath)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	recorded, err := ioutil.ReadFile(filepath.Join(path, promptHashFn))
+	if err == nil {
+		hash, err := tree.FileHash(promptPath)
+		if err != nil {
+			return false, err
+		}
+		return hash != strings.TrimSpace(string(recorded)), nil
+	}
+	if !os.IsNotExist(err) {
+		return false, err
+	}
+
+	responseFi, err := os.Stat(filepath.Join(path, tree.ResponseFn))
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return promptFi.ModTime().After(responseFi.ModTime()), nil
+}
+
+// pdfStale reports whether the PDF's text needs extracting: its
+// .pdf.txt is missing or older than it.
+func pdfStale(pdfPath string) (bool, error) {
+	pdfFi, err := os.Stat(pdfPath)
+	if err != nil {
+		return false, err
+	}
+	textFi, err := os.Stat(pdfPath + ".txt")
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return pdfFi.ModTime().After(textFi.ModTime()), nil
+}
+
+// savePromptHash records the hash of content, the node's prompt as it
+// was answered.  If prompt.txt has been changed since, the hashes
+// differ and catching up answers the change.
+func savePromptHash(path string, content []byte) error {
+	sum := sha256.Sum256(content)
+	return ioutil.WriteFile(filepath.Join(path, promptHashFn), []byte(hex.EncodeToString(sum[:])+"\n"), 0644)
+}
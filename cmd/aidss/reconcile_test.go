@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stevegt/aidss/llm"
+	"github.com/stevegt/aidss/tree"
+)
+
+func TestStaleWork(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_reconcile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	watchPath := filepath.Join(dir, "tree")
+
+	write := func(rel, content string, mtime time.Time) {
+		name := filepath.Join(watchPath, rel)
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(name, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := time.Now().Add(-time.Hour)
+	now := time.Now()
+
+	// Answered: response newer than the prompt
+	write("answered/prompt.txt", "Question", old)
+	write("answered/response.txt", "Answer", now)
+	// Unanswered: no response
+	write("unanswered/prompt.txt", "Question", now)
+	// Edited after its response
+	write("edited/prompt.txt", "Question", now)
+	write("edited/response.txt", "Answer", old)
+	// Recorded hash matches, even though the prompt is newer
+	write("hashed/prompt.txt", "Question", now)
+	write("hashed/response.txt", "Answer", old)
+	if err := savePromptHash(filepath.Join(watchPath, "hashed"), []byte("Question")); err != nil {
+		t.Fatal(err)
+	}
+	// Recorded hash differs, even though the response is newer
+	write("rehashed/prompt.txt", "Old question", old)
+	if err := savePromptHash(filepath.Join(watchPath, "rehashed"), []byte("Old question")); err != nil {
+		t.Fatal(err)
+	}
+	write("rehashed/prompt.txt", "New question", old)
+	write("rehashed/response.txt", "Answer", now)
+	// Child of an unanswered node, listed after it
+	write("unanswered/child/prompt.txt", "Question", now)
+	// Ignored
+	write("skipped/prompt.txt", "Question", now)
+	write("ignore", "skipped/\n", now)
+	// PDFs with missing, stale and fresh text
+	write("docs/new.pdf", "%PDF", now)
+	write("docs/stale.pdf", "%PDF", now)
+	write("docs/stale.pdf.txt", "Text", old)
+	write("docs/fresh.pdf", "%PDF", old)
+	write("docs/fresh.pdf.txt", "Text", now)
+
+	ignore, err := tree.LoadIgnoreRules(tree.OS, dir, watchPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prompts, pdfs, err := staleWork(watchPath, dir, ignore)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var gotPrompts []string
+	for _, p := range prompts {
+		rel, _ := filepath.Rel(watchPath, p)
+		gotPrompts = append(gotPrompts, filepath.ToSlash(rel))
+	}
+	wantPrompts := []string{"edited", "rehashed", "unanswered", "unanswered/child"}
+	if len(gotPrompts) != len(wantPrompts) {
+		t.Fatalf("Expected prompts %v, got %v", wantPrompts, gotPrompts)
+	}
+	for i := range wantPrompts {
+		if gotPrompts[i] != wantPrompts[i] {
+			t.Fatalf("Expected prompts %v, got %v", wantPrompts, gotPrompts)
+		}
+	}
+
+	var gotPDFs []string
+	for _, p := range pdfs {
+		gotPDFs = append(gotPDFs, filepath.Base(p))
+	}
+	if len(gotPDFs) != 2 || gotPDFs[0] != "new.pdf" || gotPDFs[1] != "stale.pdf" {
+		t.Errorf("Expected PDFs [new.pdf stale.pdf], got %v", gotPDFs)
+	}
+}
+
+// failingClient is an llm.Client whose requests all fail.
+type failingClient struct{}
+
+func (c failingClient) GenerateResponse(ctx context.Context, messages []llm.Message) (string, error) {
+	return "", errors.New("connection refused")
+}
+
+func (c failingClient) Model() llm.Model {
+	return llm.Model{Name: "failing-model"}
+}
+
+func TestFailedPromptRetried(t *testing.T) {
+	cases := []struct {
+		mode   string
+		prompt string
+		submit string // file written to submit, if any
+	}{
+		{triggerSave, "Question\n", ""},
+		{triggerMarker, "Question\n.send\n", ""},
+		{triggerFile, "Question\n", "go"},
+		{triggerStatus, "Status: ready\n\nQuestion\n", ""},
+	}
+	for _, c := range cases {
+		dir, err := ioutil.TempDir("", "test_retry")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		err = ioutil.WriteFile(filepath.Join(dir, tree.PromptFn), []byte(c.prompt), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.submit != "" {
+			err = ioutil.WriteFile(filepath.Join(dir, c.submit), nil, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		engine := tree.NewEngine(tree.New(tree.OS, dir, dir), failingClient{})
+		answerNode(context.Background(), engine, dir, c.mode)
+
+		// The prompt is still submitted, so catching up retries it
+		ok, err := triggered(dir, c.mode)
+		if err != nil || !ok {
+			t.Errorf("%s: expected the failed prompt to stay submitted, got %v, %v", c.mode, ok, err)
+		}
+		prompts, _, err := staleWork(dir, dir, &tree.IgnoreList{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(prompts) != 1 || prompts[0] != dir {
+			t.Errorf("%s: expected the failed prompt to be caught up on, got %v", c.mode, prompts)
+		}
+	}
+}
+
+// flakyClient is an llm.Client whose first request fails.
+type flakyClient struct {
+	calls int
+}
+
+func (c *flakyClient) GenerateResponse(ctx context.Context, messages []llm.Message) (string, error) {
+	c.calls++
+	if c.calls == 1 {
+		return "", errors.New("connection refused")
+	}
+	return "Answer", nil
+}
+
+func (c *flakyClient) Model() llm.Model {
+	return llm.Model{Name: "flaky-model"}
+}
+
+func TestFailedGoFileRetried(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_retry_go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	err = ioutil.WriteFile(filepath.Join(dir, tree.PromptFn), []byte("Question\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Wired as the daemon does: a failed request rearms its go file
+	engine := tree.NewEngine(tree.New(tree.OS, dir, dir), &flakyClient{})
+	answers := make(chan int, 10)
+	var d *debouncer
+	d = newDebouncer(20*time.Millisecond, func(name string) {
+		answer := answerNode(context.Background(), engine, filepath.Dir(name), triggerFile)
+		if answer == answerFailed {
+			d.Rearm(name)
+		}
+		answers <- answer
+	})
+	expectAnswer := func(want int) {
+		t.Helper()
+		select {
+		case got := <-answers:
+			if got != want {
+				t.Fatalf("Expected outcome %d, got %d", want, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expected the go file to fire")
+		}
+	}
+
+	goPath := filepath.Join(dir, "go")
+	err = ioutil.WriteFile(goPath, nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Event(goPath)
+	expectAnswer(answerFailed)
+
+	// Touching the unchanged go file again retries
+	now := time.Now()
+	err = os.Chtimes(goPath, now, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Event(goPath)
+	expectAnswer(answerDone)
+	if _, err := os.Stat(goPath); !os.IsNotExist(err) {
+		t.Errorf("Expected the go file to be removed once answered, got %v", err)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/stevegt/aidss/llm"
+	"github.com/stevegt/aidss/tree"
+)
+
+// defaultGrace is how long running requests get to finish on shutdown
+// by default.
+const defaultGrace = 30 * time.Second
+
+// cancelWait is how long cancelled requests get to wind down and save
+// their failure before the daemon exits anyway.
+const cancelWait = 5 * time.Second
+
+// Exit statuses of the daemon.
+const (
+	exitClean     = 0 // every running job finished
+	exitCancelled = 1 // jobs were cancelled or abandoned at shutdown
+)
+
+// daemonConfig is the configuration the daemon reloads on SIGHUP.
+type daemonConfig struct {
+	client llm.Client
+	ignore *tree.IgnoreList // directories not watched
+}
+
+// loadDaemonConfig sets up the LLM client for modelName and loads the
+// ignore rules for watchPath.
+func loadDaemonConfig(store tree.Store, watchPath, rootPath, modelName string) (*daemonConfig, error) {
+	client, err := llm.NewClient(modelName)
+	if err != nil {
+		return nil, err
+	}
+	ignore, err := tree.LoadIgnoreRules(store, rootPath, watchPath)
+	if err != nil {
+		return nil, err
+	}
+	return &daemonConfig{
+		client: client,
+		ignore: ignore.ForWatchPath(rootPath, watchPath),
+	}, nil
+}
+
+// shutdown stops queue, dropping the jobs that haven't started; they
+// are picked up again by the catch-up at the next start.  The running
+// jobs get up to grace to finish, after which cancel is called and they
+// get cancelWait more.  Temporary files left by unfinished writes are
+// then removed.  It returns the daemon's exit status.
+func shutdown(queue *jobQueue, cancel context.CancelFunc, grace time.Duration) int {
+	dropped := queue.Stop()
+	_, running := queue.Depth()
+	log.Printf("Dropped %d queued jobs; waiting up to %v for %d running", len(dropped), grace, running)
+
+	status := exitClean
+	if !queue.Wait(grace) {
+		log.Println("Cancelling the jobs still running")
+		cancel()
+		status = exitCancelled
+		if !queue.Wait(cancelWait) {
+			log.Println("Abandoning the jobs still running")
+		}
+	}
+
+	tree.RemoveTempFiles()
+	log.Println("Shut down")
+	return status
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestShutdown(t *testing.T) {
+	cases := []struct {
+		name   string
+		wait   bool // the running job waits to be cancelled
+		status int
+	}{
+		{"finished", false, exitClean},
+		{"cancelled", true, exitCancelled},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			q := newJobQueue(1, "")
+
+			started := make(chan bool)
+			cancelled := false
+			q.Add("a/prompt.txt", "a", func() {
+				close(started)
+				if !c.wait {
+					time.Sleep(20 * time.Millisecond)
+					return
+				}
+				<-ctx.Done()
+				cancelled = true
+			})
+			ran := false
+			q.Add("b/prompt.txt", "b", func() { ran = true })
+			<-started
+
+			status := shutdown(q, cancel, 500*time.Millisecond)
+			if status != c.status {
+				t.Errorf("Expected exit status %d, got %d", c.status, status)
+			}
+			if cancelled != c.wait {
+				t.Errorf("Expected cancelled to be %v", c.wait)
+			}
+			if ran {
+				t.Errorf("Expected the queued job to be dropped")
+			}
+			if q.Add("c/prompt.txt", "c", func() {}) {
+				t.Errorf("Expected a stopped queue to drop new jobs")
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/stevegt/aidss/tree"
+)
+
+// Trigger modes decide which saves submit a prompt.
+const (
+	triggerSave   = "save"   // every change to prompt.txt
+	triggerMarker = "marker" // prompt.txt ends with a .send line
+	triggerFile   = "file"   // a go or send file appears in the node
+	triggerStatus = "status" // prompt.txt has a `Status: ready` header
+)
+
+// triggerModes lists the trigger modes, default first.
+var triggerModes = []string{triggerSave, triggerMarker, triggerFile, triggerStatus}
+
+// goFns are the files that submit the node's prompt in file trigger
+// mode when created.
+var goFns = []string{"go", "send"}
+
+// Values of the Status header in status trigger mode.
+const (
+	statusReady = "ready"
+	statusDone  = "done"
+)
+
+// checkTriggerMode returns an error if mode isn't a trigger mode.
+func checkTriggerMode(mode string) error {
+	for _, m := range triggerModes {
+		if mode == m {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown trigger mode %q (%s)", mode, strings.Join(triggerModes, ", "))
+}
+
+// isGoFile reports whether name is one of the go files.
+func isGoFile(name string) bool {
+	for _, fn := range goFns {
+		if filepath.Base(name) == fn {
+			return true
+		}
+	}
+	return false
+}
+
+// triggerNode returns the node whose prompt a change to the named file
+// may submit in mode, if any.
+func triggerNode(name, mode string) (string, bool) {
+	if mode == triggerFile {
+		return filepath.Dir(name), isGoFile(name)
+	}
+	return filepath.Dir(name), filepath.Base(name) == tree.PromptFn
+}
+
+// triggered reports whether the prompt of the node at path has been
+// submitted in mode, rather than being a draft.  A prompt whose
+// headers can't be parsed counts as submitted in status mode, so that
+// the error is reported.
+func triggered(path, mode string) (bool, error) {
+	switch mode {
+	case triggerMarker:
+		data, err := ioutil.ReadFile(filepath.Join(path, tree.PromptFn))
+		if err != nil {
+			return false, err
+		}
+		_, ok := tree.CutSendMarker(string(data))
+		return ok, nil
+	case triggerFile:
+		for _, fn := range goFns {
+			_, err := os.Stat(filepath.Join(path, fn))
+			if err == nil {
+				return true, nil
+			}
+			if !os.IsNotExist(err) {
+				return false, err
+			}
+		}
+		return false, nil
+	case triggerStatus:
+		prompt, err := tree.ParsePromptFile(filepath.Join(path, tree.PromptFn))
+		if os.IsNotExist(err) {
+			return false, err
+		}
+		if err != nil {
+			return true, nil
+		}
+		return strings.EqualFold(strings.TrimSpace(prompt.Status), statusReady), nil
+	}
+	return true, nil
+}
+
+// clearTrigger resets the trigger of the node at path once sent, the
+// content of prompt.txt that was answered, has been processed, so that
+// later saves are drafts again: the .send line or the go files are
+// removed, or the Status header is set to done.  It returns the content
+// it leaves in prompt.txt.
+func clearTrigger(path, mode string, sent []byte) ([]byte, error) {
+	promptPath := filepath.Join(path, tree.PromptFn)
+	switch mode {
+	case triggerMarker:
+		content, ok := tree.CutSendMarker(string(sent))
+		if !ok {
+			return sent, nil
+		}
+		return []byte(content), tree.WriteFileAtomic(promptPath, []byte(content))
+	case triggerFile:
+		for _, fn := range goFns {
+			err := os.Remove(filepath.Join(path, fn))
+			if err != nil && !os.IsNotExist(err) {
+				return sent, err
+			}
+		}
+	case triggerStatus:
+		prompt, err := tree.ParsePrompt(tree.PromptFn, string(sent))
+		if err != nil {
+			return sent, nil
+		}
+		for _, h := range prompt.Headers {
+			if h.Name != "status" {
+				continue
+			}
+			// keep the header's name as the user spelt it
+			lines := strings.Split(string(sent), "\n")
+			name := strings.SplitN(lines[h.Line-1], ":", 2)[0]
+			lines[h.Line-1] = fmt.Sprintf("%s: %s", name, statusDone)
+			content := []byte(strings.Join(lines, "\n"))
+			return content, tree.WriteFileAtomic(promptPath, content)
+		}
+	}
+	return sent, nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stevegt/aidss/llm"
+	"github.com/stevegt/aidss/tree"
+)
+
+func TestTriggerModes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_trigger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	promptPath := filepath.Join(dir, tree.PromptFn)
+
+	cases := []struct {
+		mode    string
+		draft   string            // prompt.txt before submitting
+		submit  map[string]string // files written to submit
+		cleared string            // prompt.txt after clearing
+	}{
+		{triggerSave, "Question\n", nil, "Question\n"},
+		{triggerMarker, "Question\n", map[string]string{tree.PromptFn: "Question\n.send\n"}, "Question\n"},
+		{triggerFile, "Question\n", map[string]string{"go": ""}, "Question\n"},
+		{triggerFile, "Question\n", map[string]string{"send": ""}, "Question\n"},
+		{triggerStatus, "Status: draft\n\nQuestion\n", map[string]string{tree.PromptFn: "Status: ready\n\nQuestion\n"}, "Status: done\n\nQuestion\n"},
+		{triggerStatus, "STATUS: draft\n\nQuestion\n", map[string]string{tree.PromptFn: "STATUS: Ready\n\nQuestion\n"}, "STATUS: done\n\nQuestion\n"},
+	}
+	for _, c := range cases {
+		err := ioutil.WriteFile(promptPath, []byte(c.draft), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ok, err := triggered(dir, c.mode)
+		if err != nil {
+			t.Fatalf("%s: expected no error, got %v", c.mode, err)
+		}
+		if ok != (c.submit == nil) {
+			t.Errorf("%s: expected the draft to be triggered %v, got %v", c.mode, c.submit == nil, ok)
+		}
+		if c.submit == nil {
+			continue
+		}
+
+		for fn, content := range c.submit {
+			err = ioutil.WriteFile(filepath.Join(dir, fn), []byte(content), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		ok, err = triggered(dir, c.mode)
+		if err != nil || !ok {
+			t.Errorf("%s: expected the prompt to be triggered, got %v, %v", c.mode, ok, err)
+		}
+
+		sent, err := ioutil.ReadFile(promptPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cleared, err := clearTrigger(dir, c.mode, sent)
+		if err != nil {
+			t.Fatalf("%s: expected no error clearing, got %v", c.mode, err)
+		}
+		ok, err = triggered(dir, c.mode)
+		if err != nil || ok {
+			t.Errorf("%s: expected the trigger to be cleared, got %v, %v", c.mode, ok, err)
+		}
+		data, err := ioutil.ReadFile(promptPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != c.cleared || string(cleared) != c.cleared {
+			t.Errorf("%s: expected prompt.txt %q after clearing, got %q, returned %q", c.mode, c.cleared, data, cleared)
+		}
+	}
+}
+
+func TestTriggerNode(t *testing.T) {
+	cases := []struct {
+		name string
+		mode string
+		ok   bool
+	}{
+		{"a/prompt.txt", triggerSave, true},
+		{"a/prompt.txt", triggerMarker, true},
+		{"a/prompt.txt", triggerStatus, true},
+		{"a/prompt.txt", triggerFile, false},
+		{"a/go", triggerFile, true},
+		{"a/send", triggerFile, true},
+		{"a/go", triggerSave, false},
+		{"a/notes.txt", triggerSave, false},
+	}
+	for _, c := range cases {
+		path, ok := triggerNode(c.name, c.mode)
+		if ok != c.ok || (ok && path != "a") {
+			t.Errorf("%s in %s mode: expected %v, got %q, %v", c.name, c.mode, c.ok, path, ok)
+		}
+	}
+}
+
+// editingClient is an llm.Client that writes edit to the prompt file
+// while it answers, as a user editing during a request would.
+type editingClient struct {
+	promptPath string
+	edit       string
+}
+
+func (c editingClient) GenerateResponse(ctx context.Context, messages []llm.Message) (string, error) {
+	err := ioutil.WriteFile(c.promptPath, []byte(c.edit), 0644)
+	return "Answer", err
+}
+
+func (c editingClient) Model() llm.Model {
+	return llm.Model{Name: "editing-model"}
+}
+
+func TestPromptChangedWhileAnswered(t *testing.T) {
+	cases := []struct {
+		mode   string
+		prompt string
+		edit   string
+	}{
+		{triggerSave, "Question\n", "Better question\n"},
+		{triggerMarker, "Question\n.send\n", "Better question\n.send\n"},
+		{triggerStatus, "Status: ready\n\nQuestion\n", "Status: ready\n\nBetter question\n"},
+	}
+	for _, c := range cases {
+		dir, err := ioutil.TempDir("", "test_changed")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		promptPath := filepath.Join(dir, tree.PromptFn)
+		err = ioutil.WriteFile(promptPath, []byte(c.prompt), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The edit keeps its trigger, to be answered in turn
+		client := editingClient{promptPath: promptPath, edit: c.edit}
+		engine := tree.NewEngine(tree.New(tree.OS, dir, dir), client)
+		if got := answerNode(context.Background(), engine, dir, c.mode); got != answerChanged {
+			t.Errorf("%s: expected the change to be reported, got %d", c.mode, got)
+		}
+		data, err := ioutil.ReadFile(promptPath)
+		if err != nil || string(data) != c.edit {
+			t.Errorf("%s: expected the edit to be left alone, got %q, %v", c.mode, data, err)
+		}
+		ok, err := triggered(dir, c.mode)
+		if err != nil || !ok {
+			t.Errorf("%s: expected the edit to stay submitted, got %v, %v", c.mode, ok, err)
+		}
+
+		// Nor is it recorded as answered, so catching up answers it
+		prompts, _, err := staleWork(dir, dir, &tree.IgnoreList{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(prompts) != 1 || prompts[0] != dir {
+			t.Errorf("%s: expected the edit to be caught up on, got %v", c.mode, prompts)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/stevegt/aidss/tree"
+)
+
+// watchTree keeps the watcher's directories in step with the watch
+// tree as directories are created, removed and renamed, along with an
+// index of the nodes being watched.
+type watchTree struct {
+	watcher  tree.Watcher
+	rootPath string
+
+	mu    sync.Mutex
+	nodes map[string]bool // watched directories
+}
+
+// newWatchTree returns a watchTree adding directories to watcher.
+// Ignore rules are matched relative to rootPath.
+func newWatchTree(watcher tree.Watcher, rootPath string) *watchTree {
+	return &watchTree{
+		watcher:  watcher,
+		rootPath: rootPath,
+		nodes:    make(map[string]bool),
+	}
+}
+
+// Add watches dir and the directories below it that aren't matched by
+// ignore, such as a directory created with its contents by cp -r or
+// git checkout, and adds them to the index.  It returns the
+// directories that weren't already watched, parents before children.
+func (t *watchTree) Add(dir string, ignore *tree.IgnoreList) ([]string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var added []string
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			// removed while we walked
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			return nil
+		}
+		if p != dir && ignore.IgnoredPath(t.rootPath, p, true) {
+			return filepath.SkipDir
+		}
+		if t.nodes[p] {
+			return nil
+		}
+		err = t.watcher.Add(p)
+		if os.IsNotExist(err) {
+			return filepath.SkipDir
+		}
+		if err != nil {
+			return err
+		}
+		t.nodes[p] = true
+		added = append(added, p)
+		return nil
+	})
+	return added, err
+}
+
+// Remove stops watching dir and the directories below it, after they
+// have been removed or renamed away, and drops them from the index.
+// It returns the directories dropped, which is none if dir wasn't
+// watched.
+func (t *watchTree) Remove(dir string) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.nodes[dir] {
+		return nil
+	}
+	var removed []string
+	for p := range t.nodes {
+		if !tree.IsWithin(dir, p) {
+			continue
+		}
+		// The kernel drops the watches of deleted directories itself,
+		// so an error here just means there was nothing to remove
+		t.watcher.Remove(p)
+		delete(t.nodes, p)
+		removed = append(removed, p)
+	}
+	sort.Strings(removed)
+	return removed
+}
+
+// Nodes returns the watched directories, sorted.
+func (t *watchTree) Nodes() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var nodes []string
+	for p := range t.nodes {
+		nodes = append(nodes, p)
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+// pendingFiles returns the files in dirs that are waiting to be acted
+// on, as the catch-up at startup finds them: unanswered prompts, go
+// and send files, and PDFs without up-to-date text.  A directory that
+// arrives with its contents brings no events for them.
+func pendingFiles(dirs []string) []string {
+	var pending []string
+	for _, dir := range dirs {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Println("Error reading new directory:", err)
+			}
+			continue
+		}
+		for _, file := range files {
+			name := filepath.Join(dir, file.Name())
+			if file.IsDir() || !watchedFile(name) {
+				continue
+			}
+			var stale bool
+			switch {
+			case file.Name() == tree.PromptFn:
+				stale, err = promptStale(dir)
+			case filepath.Ext(name) == ".pdf":
+				stale, err = pdfStale(name)
+			default:
+				stale = true
+			}
+			if err != nil {
+				log.Println("Error checking new file:", err)
+				continue
+			}
+			if stale {
+				pending = append(pending, name)
+			}
+		}
+	}
+	return pending
+}
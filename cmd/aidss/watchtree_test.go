@@ -0,0 +1,238 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stevegt/aidss/tree"
+)
+
+func TestWatchTree(t *testing.T) {
+	for _, backend := range []string{tree.WatchFsnotify, tree.WatchPoll} {
+		t.Run(backend, func(t *testing.T) {
+			watcher, err := tree.NewWatcher(backend, time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer watcher.Close()
+			testWatchTree(t, watcher)
+		})
+	}
+}
+
+// testWatchTree checks that a watchTree on watcher keeps its watches in
+// step with the directories added and removed.
+func testWatchTree(t *testing.T, watcher tree.Watcher) {
+	dir, err := ioutil.TempDir("", "test_watchtree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, p := range []string{"a/b/c", "skip"} {
+		err = os.MkdirAll(filepath.Join(dir, p), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, tree.IgnoreFn), []byte("skip/\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ignore, err := tree.LoadIgnoreRules(tree.OS, dir, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ignore = ignore.ForWatchPath(dir, dir)
+
+	watches := newWatchTree(watcher, dir)
+
+	checkWatches := func(rels ...string) {
+		t.Helper()
+		var expected []string
+		for _, rel := range rels {
+			expected = append(expected, filepath.Join(dir, rel))
+		}
+		sort.Strings(expected)
+		if got := watches.Nodes(); !reflect.DeepEqual(got, expected) {
+			t.Errorf("Expected nodes %v, got %v", expected, got)
+		}
+		got := watcher.WatchList()
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("Expected watches %v, got %v", expected, got)
+		}
+	}
+
+	added, err := watches.Add(dir, ignore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(added) != 4 {
+		t.Errorf("Expected 4 directories added, got %v", added)
+	}
+	checkWatches("", "a", "a/b", "a/b/c")
+
+	// Adding again adds nothing
+	added, err = watches.Add(dir, ignore)
+	if err != nil || len(added) != 0 {
+		t.Errorf("Expected nothing added, got %v, %v", added, err)
+	}
+
+	// A directory arriving with its contents is watched throughout
+	err = os.MkdirAll(filepath.Join(dir, "x", "y", "z"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	added, err = watches.Add(filepath.Join(dir, "x"), ignore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(added) != 3 || added[0] != filepath.Join(dir, "x") {
+		t.Errorf("Expected x and below added, parents first, got %v", added)
+	}
+	checkWatches("", "a", "a/b", "a/b/c", "x", "x/y", "x/y/z")
+
+	// Removing a directory drops its subtree, and only its subtree
+	err = os.RemoveAll(filepath.Join(dir, "a", "b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	removed := watches.Remove(filepath.Join(dir, "a", "b"))
+	if len(removed) != 2 {
+		t.Errorf("Expected 2 directories removed, got %v", removed)
+	}
+	if removed := watches.Remove(filepath.Join(dir, "a", "bb")); removed != nil {
+		t.Errorf("Expected nothing removed for an unwatched path, got %v", removed)
+	}
+	checkWatches("", "a", "x", "x/y", "x/y/z")
+
+	// A rename is a remove of the old name and a create of the new
+	err = os.Rename(filepath.Join(dir, "x"), filepath.Join(dir, "w"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	watches.Remove(filepath.Join(dir, "x"))
+	_, err = watches.Add(filepath.Join(dir, "w"), ignore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkWatches("", "a", "w", "w/y", "w/y/z")
+}
+
+func TestPendingFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_pending")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(rel, content string) {
+		name := filepath.Join(dir, rel)
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("new/prompt.txt", "Question")
+	write("new/doc.pdf", "%PDF")
+	write("new/notes.md", "Notes")
+	write("answered/prompt.txt", "Question")
+	if err := savePromptHash(filepath.Join(dir, "answered"), []byte("Question")); err != nil {
+		t.Fatal(err)
+	}
+	write("answered/go", "")
+
+	pending := pendingFiles([]string{filepath.Join(dir, "answered"), filepath.Join(dir, "new")})
+	expected := []string{
+		filepath.Join(dir, "answered", "go"),
+		filepath.Join(dir, "new", "doc.pdf"),
+		filepath.Join(dir, "new", "prompt.txt"),
+	}
+	if !reflect.DeepEqual(pending, expected) {
+		t.Errorf("Expected %v, got %v", expected, pending)
+	}
+}
+
+func TestAddWatcherRecursiveIgnore(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "test_watch_ignore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootDir)
+
+	for _, dir := range []string{
+		".git/objects",
+		"node_modules/pkg",
+		"bin",
+		".aidss/round1/round2",
+		".aidss/round1/node_modules",
+		"src",
+	} {
+		err = os.MkdirAll(filepath.Join(rootDir, dir), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = ioutil.WriteFile(filepath.Join(rootDir, ".gitignore"), []byte("node_modules/\n.aidss/\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(rootDir, ".aidssignore"), []byte("/bin/\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	watcher, err := tree.NewWatcher(tree.WatchFsnotify, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+
+	// Watching the whole project skips .git, node_modules and bin
+	ignore, err := tree.LoadIgnoreRules(tree.OS, rootDir, rootDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = newWatchTree(watcher, rootDir).Add(rootDir, ignore.ForWatchPath(rootDir, rootDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{rootDir, filepath.Join(rootDir, "src")}
+	got := watcher.WatchList()
+	sort.Strings(got)
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected watches %v, got %v", expected, got)
+	}
+
+	// A watch path listed in .gitignore is still walked, but ignored
+	// directories below it are not
+	for _, p := range got {
+		watcher.Remove(p)
+	}
+	watchDir := filepath.Join(rootDir, ".aidss")
+	ignore, err = tree.LoadIgnoreRules(tree.OS, rootDir, watchDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = newWatchTree(watcher, rootDir).Add(watchDir, ignore.ForWatchPath(rootDir, watchDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []string{
+		watchDir,
+		filepath.Join(watchDir, "round1"),
+		filepath.Join(watchDir, "round1", "round2"),
+	}
+	got = watcher.WatchList()
+	sort.Strings(got)
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected watches %v, got %v", expected, got)
+	}
+}
@@ -8,8 +8,19 @@ import (
 
 // Message represents a chat message.
 type Message struct {
-	Role    string // e.g., "user", "assistant", "system"
-	Content string
+	Role       string // e.g., "user", "assistant", "system", "tool"
+	Content    string
+	Name       string     // optional name of the participant
+	ToolCalls  []ToolCall // tool calls made by an assistant message
+	ToolCallID string     // for tool messages, the call being answered
+}
+
+// ToolCall represents a tool call made by the model.
+type ToolCall struct {
+	ID        string `json:"id"`
+	Type      string `json:"type"`
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
 }
 
 // Define constants for message roles
@@ -17,17 +28,23 @@ const (
 	ChatMessageRoleUser      = "user"
 	ChatMessageRoleAssistant = "assistant"
 	ChatMessageRoleSystem    = "system"
+	ChatMessageRoleTool      = "tool"
 )
 
 // Client is the interface that all LLM clients must implement.
 type Client interface {
 	GenerateResponse(ctx context.Context, messages []Message) (string, error)
+	// Model returns the model the client talks to.
+	Model() Model
 }
 
 // Provider represents an LLM provider.
 type Provider interface {
 	// NewClient returns a new Client instance for the given model name
 	NewClient(modelName string) (Client, error)
+	// Model returns the attributes of the given model, which need no
+	// credentials.
+	Model(modelName string) (Model, error)
 	// Models returns a list of model names supported by this provider.
 	Models() []string
 }
@@ -66,6 +83,26 @@ func Models() []string {
 
 // NewClient returns a Client for the given model name.
 func NewClient(modelName string) (Client, error) {
+	provider, err := modelProvider(modelName)
+	if err != nil {
+		return nil, err
+	}
+	return provider.NewClient(modelName)
+}
+
+// LookupModel returns the attributes of the given model, such as its
+// context window and costs, without creating a client, so that no
+// credentials are needed.
+func LookupModel(modelName string) (Model, error) {
+	provider, err := modelProvider(modelName)
+	if err != nil {
+		return Model{}, err
+	}
+	return provider.Model(modelName)
+}
+
+// modelProvider returns the provider of the given model.
+func modelProvider(modelName string) (Provider, error) {
 	registryMutex.Lock()
 	defer registryMutex.Unlock()
 
@@ -77,15 +114,13 @@ func NewClient(modelName string) (Client, error) {
 	if !ok {
 		return nil, fmt.Errorf("provider %s not found for model %s", providerName, modelName)
 	}
-	return provider.NewClient(modelName)
+	return provider, nil
 }
 
 func RegisterProviders() {
-	// Initialize and register providers
-	openAIProvider := NewOpenAIProvider()
-	if openAIProvider != nil {
-		RegisterProvider("openai", openAIProvider)
-	}
+	// Initialize and register providers; their models are known even
+	// without credentials, which are only needed for a client
+	RegisterProvider("openai", NewOpenAIProvider())
 	// more providers can be added here
 
 	// Register a mock provider for testing
@@ -14,9 +14,11 @@ type MockProvider struct{}
 
 // Mock model
 var mockModel = Model{
-	Name:        "mock-model",
-	MaxTokens:   1000,
-	Temperature: 0.7,
+	Name:          "mock-model",
+	MaxTokens:     1000,
+	Temperature:   0.7,
+	ContextWindow: 16000,
+	CharsPerToken: 4,
 }
 
 // NewMockProvider creates a new instance of MockProvider
@@ -31,11 +33,21 @@ func (p *MockProvider) NewClient(modelName string) (Client, error) {
 	}, nil
 }
 
+// Model returns the mock model's attributes
+func (p *MockProvider) Model(modelName string) (Model, error) {
+	return mockModel, nil
+}
+
 // Models returns the models available in Mock
 func (p *MockProvider) Models() []string {
 	return []string{mockModel.Name}
 }
 
+// Model returns the mock model
+func (m *Mock) Model() Model {
+	return m.model
+}
+
 // GenerateResponse returns a mock response
 func (m *Mock) GenerateResponse(ctx context.Context, messages []Message) (string, error) {
 	return "This is a mock response.", nil
@@ -19,43 +19,56 @@ type OpenAIProvider struct {
 
 // Model struct represents a language model with its attributes
 type Model struct {
-	Name        string
-	MaxTokens   int
-	Temperature float32
+	Name          string
+	MaxTokens     int // tokens reserved for the response
+	Temperature   float32
+	ContextWindow int     // tokens the model accepts, prompt and response together
+	CharsPerToken float64 // average characters per token, for estimates
+	InputCost     float64 // USD per million prompt tokens
+	OutputCost    float64 // USD per million response tokens
 }
 
 // Map of model names to Model structs
 var openAIModels = map[string]Model{
 	openai.GPT3Dot5Turbo: {
-		Name:        openai.GPT3Dot5Turbo,
-		MaxTokens:   4096,
-		Temperature: 0.7,
+		Name:          openai.GPT3Dot5Turbo,
+		MaxTokens:     4096,
+		Temperature:   0.7,
+		ContextWindow: 16385,
+		CharsPerToken: 4,
+		InputCost:     0.5,
+		OutputCost:    1.5,
 	},
 	openai.GPT4: {
-		Name:        openai.GPT4,
-		MaxTokens:   8192,
-		Temperature: 0.7,
+		Name: openai.GPT4,
+		// max_tokens counts against the 8k window along with the
+		// prompt, so the 8192 used before left no room for any
+		// prompt and the API rejected every request
+		MaxTokens:     2048,
+		Temperature:   0.7,
+		ContextWindow: 8192,
+		CharsPerToken: 4,
+		InputCost:     30,
+		OutputCost:    60,
 	},
 }
 
-// NewOpenAIProvider creates a new instance of OpenAIProvider
+// NewOpenAIProvider creates a new instance of OpenAIProvider, with the
+// API key from OPENAI_API_KEY
 func NewOpenAIProvider() *OpenAIProvider {
-	apiKey := os.Getenv("OPENAI_API_KEY")
-	if apiKey == "" {
-		// Return nil if API key is not set
-		return nil
-	}
-
 	return &OpenAIProvider{
-		apiKey: apiKey,
+		apiKey: os.Getenv("OPENAI_API_KEY"),
 	}
 }
 
 // NewClient returns a new OpenAI client for the given model
 func (p *OpenAIProvider) NewClient(modelName string) (Client, error) {
-	model, ok := openAIModels[modelName]
-	if !ok {
-		return nil, errors.New("unsupported model: " + modelName)
+	model, err := p.Model(modelName)
+	if err != nil {
+		return nil, err
+	}
+	if p.apiKey == "" {
+		return nil, errors.New("OPENAI_API_KEY is not set")
 	}
 
 	// Create OpenAI client
@@ -67,6 +80,15 @@ func (p *OpenAIProvider) NewClient(modelName string) (Client, error) {
 	}, nil
 }
 
+// Model returns the attributes of the given model
+func (p *OpenAIProvider) Model(modelName string) (Model, error) {
+	model, ok := openAIModels[modelName]
+	if !ok {
+		return Model{}, errors.New("unsupported model: " + modelName)
+	}
+	return model, nil
+}
+
 // Models returns the models available in OpenAI
 func (p *OpenAIProvider) Models() []string {
 	models := make([]string, 0, len(openAIModels))
@@ -76,15 +98,33 @@ func (p *OpenAIProvider) Models() []string {
 	return models
 }
 
+// Model returns the model the client talks to
+func (o *OpenAI) Model() Model {
+	return o.model
+}
+
 // GenerateResponse implements the Client interface
 func (o *OpenAI) GenerateResponse(ctx context.Context, messages []Message) (string, error) {
 	// Convert Messages to openai.ChatCompletionMessage
 	var chatMessages []openai.ChatCompletionMessage
 	for _, msg := range messages {
-		chatMessages = append(chatMessages, openai.ChatCompletionMessage{
-			Role:    msg.Role,
-			Content: msg.Content,
-		})
+		chatMessage := openai.ChatCompletionMessage{
+			Role:       msg.Role,
+			Content:    msg.Content,
+			Name:       msg.Name,
+			ToolCallID: msg.ToolCallID,
+		}
+		for _, call := range msg.ToolCalls {
+			chatMessage.ToolCalls = append(chatMessage.ToolCalls, openai.ToolCall{
+				ID:   call.ID,
+				Type: openai.ToolType(call.Type),
+				Function: openai.FunctionCall{
+					Name:      call.Name,
+					Arguments: call.Arguments,
+				},
+			})
+		}
+		chatMessages = append(chatMessages, chatMessage)
 	}
 
 	// Build the request
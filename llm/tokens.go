@@ -0,0 +1,60 @@
+package llm
+
+import (
+	"math"
+	"unicode/utf8"
+)
+
+// MessageOverhead is the number of tokens each message costs beyond
+// its content, for the role and delimiters.
+const MessageOverhead = 4
+
+// defaultCharsPerToken is used for models that don't say.
+const defaultCharsPerToken = 4
+
+// CountTokens estimates the number of tokens text takes up for the
+// model.  It is an estimate, based on the model's average number of
+// characters per token, and errs on the high side.
+func (m Model) CountTokens(text string) int {
+	charsPerToken := m.CharsPerToken
+	if charsPerToken <= 0 {
+		charsPerToken = defaultCharsPerToken
+	}
+	return int(math.Ceil(float64(utf8.RuneCountInString(text)) / charsPerToken))
+}
+
+// CountMessageTokens estimates the number of tokens a message takes
+// up for the model.
+func (m Model) CountMessageTokens(msg Message) int {
+	tokens := MessageOverhead + m.CountTokens(msg.Content) + m.CountTokens(msg.Name)
+	for _, call := range msg.ToolCalls {
+		tokens += m.CountTokens(call.Name) + m.CountTokens(call.Arguments)
+	}
+	return tokens
+}
+
+// CountMessagesTokens estimates the number of tokens messages take up
+// for the model.
+func (m Model) CountMessagesTokens(messages []Message) int {
+	tokens := 0
+	for _, msg := range messages {
+		tokens += m.CountMessageTokens(msg)
+	}
+	return tokens
+}
+
+// PromptBudget returns the number of tokens available for the prompt
+// once room for the response is reserved, or 0 if the model's context
+// window is unknown.
+func (m Model) PromptBudget() int {
+	if m.ContextWindow <= 0 {
+		return 0
+	}
+	return m.ContextWindow - m.MaxTokens
+}
+
+// EstimateCost returns the cost in USD of sending promptTokens tokens
+// to the model and getting responseTokens tokens back.
+func (m Model) EstimateCost(promptTokens, responseTokens int) float64 {
+	return (float64(promptTokens)*m.InputCost + float64(responseTokens)*m.OutputCost) / 1e6
+}
@@ -0,0 +1,230 @@
+package tree
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/stevegt/aidss/llm"
+)
+
+// noBudget is the history budget when the model's context window is
+// unknown: the history is sent whole.
+const noBudget = -1
+
+// summaryIntro introduces a summary standing in for earlier turns.
+const summaryIntro = "Summary of the earlier conversation:\n\n"
+
+// nodeHistory is the messages contributed by one ancestor node.
+type nodeHistory struct {
+	path     string
+	messages []llm.Message
+}
+
+// elision records ancestor turns left out of the context to make it
+// fit the model's context window.
+type elision struct {
+	path       string // node whose turn was left out
+	tokens     int    // tokens the turn would have taken up
+	summarized bool   // replaced by a summary rather than dropped
+}
+
+// ancestorHistory returns the messages of the ancestors of the node at
+// path, oldest first, one entry per node.
+func ancestorHistory(store Store, path, watchPath string) []nodeHistory {
+	parentPath := filepath.Dir(path)
+	if path == watchPath || parentPath == path {
+		return nil
+	}
+	var history []nodeHistory
+	for _, p := range nodePaths(parentPath, watchPath) {
+		messages := nodeMessages(store, p)
+		if len(messages) == 0 {
+			continue
+		}
+		history = append(history, nodeHistory{path: p, messages: messages})
+	}
+	return history
+}
+
+// compactHistory fits history into budget tokens.  If the whole
+// history doesn't fit, the oldest turns are replaced by the summary of
+// the conversation down to the newest of them, using as few summarized
+// turns as possible.  If even that doesn't fit, or no summary can be
+// had, the oldest turns are dropped.  Summaries are read from the
+// nodes' summary.txt and regenerated with client if missing or stale; a
+// nil client never generates one.  It returns the messages to send and
+// the turns left out.
+func compactHistory(ctx context.Context, store Store, history []nodeHistory, budget int, model llm.Model, client llm.Client) ([]llm.Message, []elision, error) {
+	tokens := make([]int, len(history))
+	total := 0
+	for i, node := range history {
+		tokens[i] = model.CountMessagesTokens(node.messages)
+		total += tokens[i]
+	}
+	if budget == noBudget || total <= budget {
+		return flattenHistory(history), nil, nil
+	}
+
+	// Summarize the oldest turns, as few as will do
+	rest := total
+	summary := ""
+	for k := range history {
+		rest -= tokens[k]
+		var err error
+		summary, err = nodeSummary(ctx, store, history, k, summary, model, client)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, nil, ctx.Err()
+			}
+			// drop the turns rather than fail the request
+			log.Printf("Error summarizing %s: %v", history[k].path, err)
+			summary = ""
+		}
+		if summary == "" {
+			continue
+		}
+		summaryMessage := llm.Message{
+			Role:    llm.ChatMessageRoleUser,
+			Content: summaryIntro + summary,
+		}
+		if model.CountMessageTokens(summaryMessage)+rest > budget {
+			continue
+		}
+		var elided []elision
+		for i := 0; i <= k; i++ {
+			elided = append(elided, elision{path: history[i].path, tokens: tokens[i], summarized: true})
+		}
+		messages := append([]llm.Message{summaryMessage}, flattenHistory(history[k+1:])...)
+		return messages, elided, nil
+	}
+
+	// Drop the oldest turns, as few as will do
+	var elided []elision
+	rest = total
+	for k := range history {
+		rest -= tokens[k]
+		elided = append(elided, elision{path: history[k].path, tokens: tokens[k]})
+		if rest <= budget {
+			return flattenHistory(history[k+1:]), elided, nil
+		}
+	}
+	return nil, elided, nil
+}
+
+// flattenHistory returns the messages of history in order.
+func flattenHistory(history []nodeHistory) []llm.Message {
+	var messages []llm.Message
+	for _, node := range history {
+		messages = append(messages, node.messages...)
+	}
+	return messages
+}
+
+// nodeSummary returns the summary of the conversation down to
+// history[k], given prev, the summary down to history[k-1].  The node's
+// summary.txt is used if it is newer than every turn it covers;
+// otherwise a summary of prev and the node's own turn is generated with
+// client and saved, so that no summary request holds more than one
+// turn.  It returns "" if client is nil or, past the first node, prev
+// is.
+func nodeSummary(ctx context.Context, store Store, history []nodeHistory, k int, prev string, model llm.Model, client llm.Client) (string, error) {
+	path := history[k].path
+	summaryPath := filepath.Join(path, SummaryFn)
+	fi, err := store.Stat(summaryPath)
+	if err == nil && !summaryStale(store, fi, path, history) {
+		data, err := store.ReadFile(summaryPath)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	if client == nil || (k > 0 && prev == "") {
+		return "", nil
+	}
+
+	messages := summaryMessages(prev, history[k].messages)
+	if budget := model.PromptBudget(); budget > 0 {
+		if tokens := model.CountMessagesTokens(messages); tokens > budget {
+			return "", fmt.Errorf("summary request exceeds the context window of %s by %d tokens", model.Name, tokens-budget)
+		}
+	}
+	summary, err := getLLMResponse(ctx, messages, client)
+	if err != nil {
+		return "", err
+	}
+	err = store.WriteFileAtomic(summaryPath, []byte(summary))
+	if err != nil {
+		return "", fmt.Errorf("error writing summary: %v", err)
+	}
+	log.Println("Summary written to:", summaryPath)
+	return strings.TrimSpace(summary), nil
+}
+
+// summaryMessages returns the request for a summary of the
+// conversation summarized by prev, if any, followed by turn.
+func summaryMessages(prev string, turn []llm.Message) []llm.Message {
+	var builder strings.Builder
+	builder.WriteString("Please provide a concise summary of the following conversation")
+	if prev != "" {
+		builder.WriteString(", which continues from the summary given first")
+	}
+	builder.WriteString(":\n\n")
+	if prev != "" {
+		builder.WriteString(summaryIntro + prev + "\n\n")
+	}
+	for _, msg := range turn {
+		builder.WriteString(msg.Role + ": " + msg.Content + "\n")
+	}
+	return []llm.Message{{Role: llm.ChatMessageRoleUser, Content: builder.String()}}
+}
+
+// summaryStale reports whether the summary.txt described by fi is
+// older than any turn in history up to and including path's.
+func summaryStale(store Store, fi os.FileInfo, path string, history []nodeHistory) bool {
+	for _, node := range history {
+		for _, fn := range []string{MessagesFn, ResponseFn} {
+			turnFi, err := store.Stat(filepath.Join(node.path, fn))
+			if err == nil && turnFi.ModTime().After(fi.ModTime()) {
+				return true
+			}
+		}
+		if node.path == path {
+			break
+		}
+	}
+	return false
+}
+
+// saveElided lists the ancestor turns left out of the node's context
+// in its elided.txt, or removes elided.txt if there are none.
+func saveElided(store Store, path, watchPath string, elided []elision) error {
+	elidedPath := filepath.Join(path, ElidedFn)
+	if len(elided) == 0 {
+		err := store.Remove(elidedPath)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	var builder strings.Builder
+	for _, e := range elided {
+		rel, err := filepath.Rel(watchPath, e.path)
+		if err != nil {
+			rel = e.path
+		}
+		action := "dropped"
+		if e.summarized {
+			action = "summarized"
+		}
+		builder.WriteString(fmt.Sprintf("%s: %s (%d tokens)\n", action, filepath.ToSlash(rel), e.tokens))
+	}
+	return store.WriteFile(elidedPath, []byte(builder.String()))
+}
@@ -0,0 +1,249 @@
+package tree
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stevegt/aidss/llm"
+)
+
+// testHistory returns a history of n nodes, each with a user message
+// and a response of size characters.
+func testHistory(dir string, n, size int) []nodeHistory {
+	var history []nodeHistory
+	for i := 0; i < n; i++ {
+		dir = filepath.Join(dir, fmt.Sprintf("node%d", i))
+		history = append(history, nodeHistory{
+			path: dir,
+			messages: []llm.Message{
+				{Role: llm.ChatMessageRoleUser, Content: strings.Repeat("q", size)},
+				{Role: llm.ChatMessageRoleAssistant, Content: strings.Repeat("a", size)},
+			},
+		})
+	}
+	return history
+}
+
+func TestCompactHistory(t *testing.T) {
+	model := llm.Model{Name: "test-model", CharsPerToken: 4}
+
+	// Each node takes 2 * (4 + 100/4) = 58 tokens
+	history := testHistory("/tmp/watch", 4, 100)
+
+	cases := []struct {
+		name     string
+		budget   int
+		messages int
+		dropped  int
+	}{
+		{"unlimited", noBudget, 8, 0},
+		{"fits", 4 * 58, 8, 0},
+		{"drop one", 3 * 58, 6, 1},
+		{"drop three", 58, 2, 3},
+		{"drop all", 57, 0, 4},
+	}
+	for _, c := range cases {
+		messages, elided, err := compactHistory(context.Background(), OS, history, c.budget, model, nil)
+		if err != nil {
+			t.Fatalf("%s: expected no error, got %v", c.name, err)
+		}
+		if len(messages) != c.messages {
+			t.Errorf("%s: expected %d messages, got %d", c.name, c.messages, len(messages))
+		}
+		if len(elided) != c.dropped {
+			t.Errorf("%s: expected %d turns dropped, got %d", c.name, c.dropped, len(elided))
+		}
+		for _, e := range elided {
+			if e.summarized || e.tokens != 58 {
+				t.Errorf("%s: unexpected elision %+v", c.name, e)
+			}
+		}
+	}
+}
+
+func TestCompactHistorySummary(t *testing.T) {
+	watchDir, err := ioutil.TempDir("", "test_compact")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(watchDir)
+
+	model := llm.Model{Name: "test-model", CharsPerToken: 4}
+	history := testHistory(watchDir, 4, 100)
+	for _, node := range history {
+		err = os.MkdirAll(node.path, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	client := &recordingClient{}
+
+	// Two turns' worth of budget: the first two turns make way for a
+	// summary, which is generated since there is no summary.txt yet
+	messages, elided, err := compactHistory(context.Background(), OS, history, 2*58+20, model, client)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(client.calls) == 0 {
+		t.Fatalf("Expected a summary to be generated")
+	}
+	if len(messages) != 5 || messages[0].Content != summaryIntro+"Recorded response." {
+		t.Fatalf("Expected a summary and two turns, got %+v", messages)
+	}
+	if len(elided) != 2 || !elided[0].summarized || !elided[1].summarized {
+		t.Errorf("Expected two summarized turns, got %+v", elided)
+	}
+	if _, err := os.Stat(filepath.Join(history[1].path, SummaryFn)); err != nil {
+		t.Errorf("Expected the summary to be saved: %v", err)
+	}
+
+	// The saved summary is reused while it is up to date
+	calls := len(client.calls)
+	_, _, err = compactHistory(context.Background(), OS, history, 2*58+20, model, client)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(client.calls) != calls {
+		t.Errorf("Expected the saved summary to be reused")
+	}
+
+	// Without a client a missing summary can't be generated, so the
+	// oldest turns are dropped instead
+	err = os.Remove(filepath.Join(history[1].path, SummaryFn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages, elided, err = compactHistory(context.Background(), OS, history, 2*58+20, model, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(messages) != 4 || len(elided) != 2 || elided[0].summarized {
+		t.Errorf("Expected two dropped turns, got %d messages and %+v", len(messages), elided)
+	}
+}
+
+func TestHandleUserMessageBudget(t *testing.T) {
+	watchDir, err := ioutil.TempDir("", "test_budget")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(watchDir)
+
+	client := &recordingClient{model: llm.Model{
+		Name:          "small-model",
+		MaxTokens:     100,
+		ContextWindow: 300,
+		CharsPerToken: 4,
+	}}
+	ask := func(dir, prompt string) {
+		err := os.MkdirAll(dir, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(filepath.Join(dir, PromptFn), []byte(prompt), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		handleUserMessage(context.Background(), OS, dir, client, watchDir, watchDir)
+	}
+
+	// Each turn takes about 100 tokens, so only the last one fits
+	dir := watchDir
+	for i := 0; i < 3; i++ {
+		dir = filepath.Join(dir, fmt.Sprintf("node%d", i))
+		ask(dir, strings.Repeat("x", 360))
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, ElidedFn))
+	if err != nil {
+		t.Fatalf("Expected elided.txt, got error: %v", err)
+	}
+	if !strings.Contains(string(data), "node0") {
+		t.Errorf("Expected elided.txt to list node0, got %q", data)
+	}
+	if tokens := client.model.CountMessagesTokens(client.lastCall()); tokens > client.model.PromptBudget() {
+		t.Errorf("Expected at most %d tokens, sent %d", client.model.PromptBudget(), tokens)
+	}
+
+	// A prompt that doesn't fit at all is an error
+	calls := len(client.calls)
+	ask(filepath.Join(dir, "big"), strings.Repeat("x", 2000))
+	if len(client.calls) != calls {
+		t.Errorf("Expected an oversized prompt not to be sent")
+	}
+	data, err = ioutil.ReadFile(filepath.Join(dir, "big", ErrorFn))
+	if err != nil || !strings.Contains(string(data), "context window") {
+		t.Errorf("Expected error.txt to report the context window, got %q, %v", data, err)
+	}
+}
+
+// limitedClient is a recordingClient that refuses, as the API does,
+// requests that don't leave room for the response, and, if
+// failSummaries is set, every summary request.
+type limitedClient struct {
+	recordingClient
+	failSummaries bool
+}
+
+func (c *limitedClient) GenerateResponse(ctx context.Context, messages []llm.Message) (string, error) {
+	if tokens := c.model.CountMessagesTokens(messages); tokens > c.model.PromptBudget() {
+		return "", fmt.Errorf("context_length_exceeded: %d tokens", tokens)
+	}
+	if c.failSummaries && strings.HasPrefix(messages[0].Content, "Please provide a concise summary") {
+		return "", fmt.Errorf("summary refused")
+	}
+	return c.recordingClient.GenerateResponse(ctx, messages)
+}
+
+func TestHandleUserMessageDeepChain(t *testing.T) {
+	for _, failSummaries := range []bool{false, true} {
+		watchDir, err := ioutil.TempDir("", "test_deep_chain")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(watchDir)
+
+		client := &limitedClient{failSummaries: failSummaries}
+		client.model = llm.Model{
+			Name:          "small-model",
+			MaxTokens:     100,
+			ContextWindow: 300,
+			CharsPerToken: 4,
+		}
+
+		// The history grows to several times the context window, yet
+		// every summary request holds a single turn, and if summaries
+		// fail the oldest turns are dropped instead
+		dir := watchDir
+		for i := 0; i < 8; i++ {
+			dir = filepath.Join(dir, fmt.Sprintf("node%d", i))
+			err = os.MkdirAll(dir, 0755)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = ioutil.WriteFile(filepath.Join(dir, PromptFn), []byte(strings.Repeat("x", 360)), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = handleUserMessage(context.Background(), OS, dir, client, watchDir, watchDir)
+			if err != nil {
+				t.Fatalf("failSummaries %v: expected node%d to be answered, got %v", failSummaries, i, err)
+			}
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, ElidedFn))
+		if err != nil {
+			t.Fatalf("failSummaries %v: expected elided.txt, got error: %v", failSummaries, err)
+		}
+		action := "summarized: "
+		if failSummaries {
+			action = "dropped: "
+		}
+		if !strings.Contains(string(data), action+"node0") {
+			t.Errorf("failSummaries %v: expected elided.txt to start %q, got %q", failSummaries, action, data)
+		}
+	}
+}
@@ -0,0 +1,488 @@
+package tree
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/stevegt/aidss/llm"
+)
+
+// Engine asks the prompts of a Tree's nodes of a language model.
+type Engine struct {
+	Tree   *Tree
+	Client llm.Client
+}
+
+// NewEngine returns an Engine asking the nodes of t of client.
+func NewEngine(t *Tree, client llm.Client) *Engine {
+	return &Engine{Tree: t, Client: client}
+}
+
+// Ask asks the node's prompt, with the conversation leading to it, of
+// the language model, and saves the exchange in the node and the Out
+// files in the project.  It returns the first error that stopped it,
+// which is also saved to the node's error.txt.  Cancelling ctx abandons
+// the request.
+func (e *Engine) Ask(ctx context.Context, node *Node) error {
+	return handleUserMessage(ctx, e.Tree.Store, node.Path, e.Client, e.Tree.Path, e.Tree.Root)
+}
+
+// Summarize summarizes the conversation from the tree's root down to
+// node, which must have been answered, and saves it to the node's
+// summary.txt.  The summary is built turn by turn from the ancestors'
+// summaries, which are generated too if missing or stale.
+func (e *Engine) Summarize(ctx context.Context, node *Node) (string, error) {
+	store := e.Tree.Store
+	messages := nodeMessages(store, node.Path)
+	if len(messages) == 0 {
+		return "", fmt.Errorf("%s has not been answered", node.Path)
+	}
+	history := append(ancestorHistory(store, node.Path, e.Tree.Path), nodeHistory{path: node.Path, messages: messages})
+	summary := ""
+	for k := range history {
+		var err error
+		summary, err = nodeSummary(ctx, store, history, k, summary, e.Client.Model(), e.Client)
+		if err != nil {
+			return "", err
+		}
+	}
+	return summary, nil
+}
+
+// request is what handleUserMessage sends the language model for a
+// node, and what it needs to record the exchange afterwards.
+type request struct {
+	prompt     *Prompt
+	basePath   string              // what In and Out files are relative to
+	messages   []llm.Message       // the messages to send
+	transcript []TranscriptMessage // the system message, if any, and Refs
+	user       TranscriptMessage   // the node's own turn
+	elided     []elision           // ancestor turns left out to fit
+}
+
+// handleUserMessage handles a user message by generating a response
+// from the language model.  It returns the first error that stopped
+// it, which is also saved to the node's error.txt; error.txt is removed
+// once the node is answered.  Cancelling ctx abandons the request.
+func handleUserMessage(ctx context.Context, store Store, path string, client llm.Client, watchPath, rootPath string) error {
+	req, err := buildRequest(ctx, store, path, client.Model(), client, watchPath, rootPath)
+	if err != nil {
+		// e.g. prompt.txt:LINE: message, where the user will see it
+		saveErr := saveError(store, path, err)
+		if saveErr != nil {
+			log.Println("Error saving error file:", saveErr)
+		}
+		return fmt.Errorf("error building request: %v", err)
+	}
+	for _, warning := range req.prompt.Warnings {
+		log.Println("Warning:", warning)
+	}
+
+	err = sendRequest(ctx, store, path, req, client, watchPath, rootPath)
+	saveErr := saveError(store, path, err)
+	if saveErr != nil {
+		log.Println("Error saving error file:", saveErr)
+	}
+	return err
+}
+
+// sendRequest sends req, built for the node at path, to the language
+// model and saves the response and the files it updates.
+func sendRequest(ctx context.Context, store Store, path string, req *request, client llm.Client, watchPath, rootPath string) error {
+	prompt, basePath := req.prompt, req.basePath
+	contextMessages, transcript, userMessage := req.messages, req.transcript, req.user
+
+	err := saveElided(store, path, watchPath, req.elided)
+	if err != nil {
+		return fmt.Errorf("error saving elided context: %v", err)
+	}
+
+	// Save the full prompt message to prompt-full.txt for the user
+	err = saveFullPrompt(store, path, prompt, contextMessages)
+	if err != nil {
+		return fmt.Errorf("error saving full prompt: %v", err)
+	}
+
+	// Keep the notes below .stop with the node, out of the LLM's view
+	err = saveNotes(store, path, prompt.Notes)
+	if err != nil {
+		return fmt.Errorf("error saving notes: %v", err)
+	}
+
+	response, err := getLLMResponse(ctx, contextMessages, client)
+	if err != nil {
+		return fmt.Errorf("error getting LLM response: %v", err)
+	}
+
+	// Save the LLM response
+	responsePath := filepath.Join(path, ResponseFn)
+	err = store.WriteFile(responsePath, []byte(response))
+	if err != nil {
+		return fmt.Errorf("error writing LLM response: %v", err)
+	}
+
+	log.Println("LLM response written to:", responsePath)
+
+	// Save this node's transcript, which descendants will read back
+	transcript = append(transcript, userMessage, TranscriptMessage{
+		Role:      llm.ChatMessageRoleAssistant,
+		Content:   response,
+		Timestamp: time.Now().UTC(),
+		Model:     client.Model().Name,
+	})
+	err = saveTranscript(store, path, transcript)
+	if err != nil {
+		return fmt.Errorf("error saving transcript: %v", err)
+	}
+
+	// Parse the LLM response for updated files
+	err = processLLMResponse(store, response, prompt.OutFiles, basePath, rootPath)
+	if err != nil {
+		return fmt.Errorf("error processing LLM response: %v", err)
+	}
+	return nil
+}
+
+// buildRequest builds the request for the node at path: the effective
+// headers, the system message, the ancestors' turns compacted to fit
+// model's context window, the nodes named in Ref headers, and the
+// node's own prompt with its In files.
+// Summaries needed for compaction are generated with client unless it
+// is nil.  Nothing is written to the node.
+func buildRequest(ctx context.Context, store Store, path string, model llm.Model, client llm.Client, watchPath, rootPath string) (*request, error) {
+	prompt, err := loadPrompt(store, path, watchPath, rootPath)
+	if err != nil {
+		return nil, err
+	}
+	req := &request{prompt: prompt}
+
+	// The system message, if any, comes first
+	sysMsg, err := effectiveSysMsg(store, prompt, path, watchPath)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving system message: %v", err)
+	}
+	if sysMsg != "" {
+		systemMessage := TranscriptMessage{
+			Role:      llm.ChatMessageRoleSystem,
+			Content:   sysMsg,
+			Timestamp: time.Now().UTC(),
+		}
+		req.messages = append(req.messages, systemMessage.Message())
+		req.transcript = append(req.transcript, systemMessage)
+	}
+
+	// In and Out files are relative to the project root, or to the
+	// Root: header if given
+	req.basePath, err = promptBasePath(store, prompt, rootPath)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving Root header: %v", err)
+	}
+
+	// Expand globs and directories in the In header, skipping ignored
+	// files
+	ignore, err := LoadIgnoreRules(store, rootPath, watchPath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading ignore file: %v", err)
+	}
+	inFiles, err := newFileSpec(prompt.InFiles).Expand(store, req.basePath, rootPath, ignore)
+	if err != nil {
+		return nil, fmt.Errorf("error expanding In files: %v", err)
+	}
+
+	// Read and include contents of InFiles
+	attachments, err := readInFiles(store, inFiles, req.basePath, rootPath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading In files: %v", err)
+	}
+	// Add the excerpts of the Retrieve corpora most relevant to the
+	// prompt
+	excerpts, err := retrieveExcerpts(store, prompt, path, watchPath, req.basePath, rootPath, ignore)
+	if err != nil {
+		return nil, err
+	}
+	turn := &Turn{
+		Prompt:      prompt.PromptText,
+		Attachments: attachments,
+		Excerpts:    excerpts,
+	}
+	req.user = userTranscriptMessage(turn, time.Now().UTC())
+
+	// Include the nodes named in Ref headers, from other branches
+	refs, err := refMessages(store, prompt, path, watchPath)
+	if err != nil {
+		return nil, err
+	}
+	var refMsgs []llm.Message
+	for _, ref := range refs {
+		refMsgs = append(refMsgs, ref.Message())
+	}
+	req.transcript = append(req.transcript, refs...)
+
+	// Build context messages from the ancestors' turns, compacted to
+	// fit what's left of the context window after the system message,
+	// the Refs, the new user message and room for the response; this
+	// node's own earlier turn, if any, is being replaced
+	budget := noBudget
+	if promptBudget := model.PromptBudget(); promptBudget > 0 {
+		budget = promptBudget - model.CountMessagesTokens(req.messages) - model.CountMessagesTokens(refMsgs) - model.CountMessageTokens(req.user.Message())
+		if budget < 0 {
+			return nil, fmt.Errorf("system message, Refs, prompt and In files exceed the context window of %s by %d tokens", model.Name, -budget)
+		}
+	}
+	history, elided, err := compactHistory(ctx, store, ancestorHistory(store, path, watchPath), budget, model, client)
+	if err != nil {
+		return nil, fmt.Errorf("error compacting context: %v", err)
+	}
+	req.elided = elided
+	req.messages = append(req.messages, history...)
+	req.messages = append(req.messages, refMsgs...)
+
+	// Append the new user message
+	req.messages = append(req.messages, req.user.Message())
+	return req, nil
+}
+
+// processLLMResponse writes the <OUT> files found in the LLM response.
+// Only files named by the outFiles entries are written; they are
+// resolved relative to basePath and must stay within rootPath.
+func processLLMResponse(store Store, response string, outFiles []string, basePath, rootPath string) error {
+	// Wrap the response in a root element to make it valid XML
+	wrappedResponse := "<root>" + response + "</root>"
+
+	// Parse the XML
+	type OutFile struct {
+		Filename string `xml:"filename,attr"`
+		Content  string `xml:",innerxml"`
+	}
+	type Root struct {
+		OutFiles []OutFile `xml:"OUT"`
+	}
+
+	var root Root
+	err := xml.Unmarshal([]byte(wrappedResponse), &root)
+	if err != nil {
+		return fmt.Errorf("error parsing LLM response XML: %v", err)
+	}
+
+	// Map of cleaned filename to content, refusing files in the LLM
+	// response not specified in outFiles
+	spec := newFileSpec(outFiles)
+	var filenames []string
+	outFileContents := make(map[string]string)
+	for _, outFile := range root.OutFiles {
+		filename := cleanEntry(outFile.Filename)
+		if !spec.Allows(filename) {
+			log.Printf("Warning: Filename %s found in LLM response but not specified in Out: section; not written", outFile.Filename)
+			continue
+		}
+		if _, ok := outFileContents[filename]; !ok {
+			filenames = append(filenames, filename)
+		}
+		content := strings.TrimPrefix(outFile.Content, "\n")
+		content = strings.TrimSuffix(content, "\n")
+		outFileContents[filename] = content
+	}
+
+	// Warn about files listed by name that the LLM didn't provide
+	for _, filename := range spec.Literals() {
+		if _, ok := outFileContents[filename]; !ok {
+			log.Printf("Warning: Filename %s specified in Out: section but not found in LLM response", filename)
+		}
+	}
+
+	// Resolve every file before writing any of them, so that a
+	// single bad path doesn't leave a partial update behind
+	outPaths := make(map[string]string)
+	for _, filename := range filenames {
+		absPath, err := resolvePath(store, rootPath, basePath, filename)
+		if err != nil {
+			return fmt.Errorf("error resolving Out file: %v", err)
+		}
+		outPaths[filename] = absPath
+	}
+
+	for _, filename := range filenames {
+		content := outFileContents[filename]
+
+		// Replace the file atomically, so that nothing sees it half
+		// written
+		absPath := outPaths[filename]
+		err := store.WriteFileAtomic(absPath, []byte(content))
+		if err != nil {
+			return err
+		}
+		log.Printf("Updated file written to: %s", absPath)
+	}
+
+	return nil
+}
+
+// buildContextMessages builds a list of chat messages from the root to the current directory
+// to provide context to the language model.  System messages recorded by the nodes are left
+// out; see effectiveSysMsg.
+func buildContextMessages(store Store, path string, watchPath string) []llm.Message {
+	var messages []llm.Message
+
+	// Build messages from root to current directory
+	for _, p := range nodePaths(path, watchPath) {
+		messages = append(messages, nodeMessages(store, p)...)
+	}
+
+	return messages
+}
+
+// nodeMessages returns the messages contributed by the node at path,
+// from its messages.json, or just its response.txt for a node without
+// one, such as one written by hand
+func nodeMessages(store Store, path string) []llm.Message {
+	var messages []llm.Message
+	transcript, err := loadTranscript(store, path)
+	if err == nil {
+		for _, msg := range transcript {
+			if msg.Role == llm.ChatMessageRoleSystem {
+				continue
+			}
+			messages = append(messages, msg.Message())
+		}
+		return messages
+	}
+	if !os.IsNotExist(err) {
+		log.Println("Error loading transcript:", err)
+	}
+
+	if content, err := store.ReadFile(filepath.Join(path, ResponseFn)); err == nil {
+		messages = append(messages, llm.Message{
+			Role:    llm.ChatMessageRoleAssistant,
+			Content: string(content),
+		})
+	}
+	return messages
+}
+
+// nodePaths returns the directories from watchPath down to path
+func nodePaths(path string, watchPath string) []string {
+	var paths []string
+	currentPath := path
+	for {
+		paths = append([]string{currentPath}, paths...)
+		if currentPath == watchPath {
+			// stop at the watch path
+			break
+		}
+		parentPath := filepath.Dir(currentPath)
+		if parentPath == currentPath {
+			// stop at the filesystem root
+			break
+		}
+		currentPath = parentPath
+	}
+	return paths
+}
+
+// saveFullPrompt saves the full prompt message to prompt-full.txt,
+// preceded by the effective headers and where each came from and by
+// any warnings, such as headers that were ignored.  The file is for
+// the user's benefit only; it is never read back.
+func saveFullPrompt(store Store, path string, prompt *Prompt, messages []llm.Message) error {
+	var builder strings.Builder
+	if len(prompt.Headers) > 0 {
+		builder.WriteString(prompt.FormatHeaders())
+	}
+	for _, warning := range prompt.Warnings {
+		builder.WriteString(fmt.Sprintf("Warning: %s\n", warning))
+	}
+	if len(prompt.Headers) > 0 || len(prompt.Warnings) > 0 {
+		builder.WriteString("\n")
+	}
+	for _, msg := range messages {
+		builder.WriteString(fmt.Sprintf("%s: %s\n", strings.Title(msg.Role), msg.Content))
+	}
+	fullPromptPath := filepath.Join(path, PromptFullFn)
+	err := store.WriteFile(fullPromptPath, []byte(builder.String()))
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// saveNotes saves the prompt's notes to notes.txt, or removes a
+// stale notes.txt if the prompt has none
+func saveNotes(store Store, path string, notes string) error {
+	notesPath := filepath.Join(path, NotesFn)
+	if notes == "" {
+		err := store.Remove(notesPath)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return store.WriteFile(notesPath, []byte(notes))
+}
+
+// saveError saves err to the node's error.txt, or removes error.txt if
+// err is nil
+func saveError(store Store, path string, err error) error {
+	errorPath := filepath.Join(path, ErrorFn)
+	if err == nil {
+		err = store.Remove(errorPath)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return store.WriteFile(errorPath, []byte(err.Error()+"\n"))
+}
+
+func getLLMResponse(ctx context.Context, messages []llm.Message, client llm.Client) (string, error) {
+	response, err := client.GenerateResponse(ctx, messages)
+	if err != nil {
+		return "", err
+	}
+	return response, nil
+}
+
+func createNewDecisionNode(store Store, parentPath, descriptor string) (string, error) {
+	// Sanitize the descriptor to remove invalid characters
+	sanitizedDescriptor := sanitizeDescriptor(descriptor)
+
+	// Generate a unique identifier
+	uuidStr := generateUUID()
+
+	// Combine to create the directory name
+	dirName := fmt.Sprintf("%s_%s", sanitizedDescriptor, uuidStr)
+	newPath := filepath.Join(parentPath, dirName)
+
+	// The parent must already exist
+	_, err := store.Stat(parentPath)
+	if err != nil {
+		return "", err
+	}
+	err = store.MkdirAll(newPath)
+	if err != nil {
+		return "", err
+	}
+	return newPath, nil
+}
+
+func sanitizeDescriptor(descriptor string) string {
+	// Replace spaces with underscores, remove special characters
+	descriptor = strings.ReplaceAll(descriptor, " ", "_")
+	descriptor = strings.ReplaceAll(descriptor, "/", "_")
+	descriptor = strings.ReplaceAll(descriptor, "\\", "_")
+	// Add more replacements as needed
+	return descriptor
+}
+
+func generateUUID() string {
+	// Generate a UUID
+	id := uuid.New()
+	return id.String()
+}
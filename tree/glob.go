@@ -0,0 +1,245 @@
+package tree
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// fileSpec is the compiled list of entries from an In or Out header.
+// Entries are literal files, directories (which stand for every file
+// below them), or globs where `**` matches any number of directories.
+// Entries starting with `!` exclude matching files; they follow
+// gitignore rules, so `!*_test.go` excludes test files at any depth.
+type fileSpec struct {
+	include []string
+	exclude IgnoreList
+}
+
+// newFileSpec compiles the entries of an In or Out header.
+func newFileSpec(entries []string) *fileSpec {
+	spec := &fileSpec{}
+	var excludes []string
+	for _, entry := range entries {
+		if strings.HasPrefix(entry, "!") {
+			excludes = append(excludes, entry[1:])
+			continue
+		}
+		spec.include = append(spec.include, cleanEntry(entry))
+	}
+	spec.exclude.parseIgnoreLines(excludes, "")
+	return spec
+}
+
+// cleanEntry normalizes a header entry to a clean, slash-separated
+// path.
+func cleanEntry(entry string) string {
+	return path.Clean(filepath.ToSlash(entry))
+}
+
+// hasGlobMeta reports whether entry contains glob metacharacters.
+func hasGlobMeta(entry string) bool {
+	return strings.ContainsAny(entry, "*?[")
+}
+
+// Expand returns the files the spec names, relative to basePath.
+// Globs and directories are expanded by walking the tree, skipping
+// files matched by ignore (relative to rootPath); literal file names
+// are returned as is, whether or not they exist, so that callers can
+// report missing files.
+func (s *fileSpec) Expand(store Store, basePath, rootPath string, ignore *IgnoreList) ([]string, error) {
+	var files []string
+	seen := make(map[string]bool)
+	add := func(name string) {
+		if seen[name] || s.exclude.Match(name, false) {
+			return
+		}
+		seen[name] = true
+		files = append(files, name)
+	}
+
+	for _, entry := range s.include {
+		if !hasGlobMeta(entry) {
+			absPath, err := resolvePath(store, rootPath, basePath, entry)
+			if err != nil {
+				return nil, err
+			}
+			fi, err := store.Stat(absPath)
+			if err != nil || !fi.IsDir() {
+				add(entry)
+				continue
+			}
+			names, err := walkFiles(store, absPath, basePath, rootPath, ignore)
+			if err != nil {
+				return nil, err
+			}
+			for _, name := range names {
+				add(name)
+			}
+			continue
+		}
+
+		// Only walk the part of the tree the pattern can match
+		dir, err := resolvePath(store, rootPath, basePath, globPrefix(entry))
+		if err != nil {
+			return nil, err
+		}
+		names, err := walkFiles(store, dir, basePath, rootPath, ignore)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			if matchGlob(entry, name) {
+				add(name)
+			}
+		}
+	}
+	return files, nil
+}
+
+// Allows reports whether the spec names the file name, given relative
+// to the same base as the spec's entries.  Unlike Expand it doesn't
+// need the file to exist, so it is used to vet files to be written.
+func (s *fileSpec) Allows(name string) bool {
+	name = cleanEntry(name)
+	if s.exclude.Match(name, false) {
+		return false
+	}
+	for _, entry := range s.include {
+		switch {
+		case hasGlobMeta(entry):
+			if matchGlob(entry, name) {
+				return true
+			}
+		case entry == ".":
+			if !strings.HasPrefix(name, "../") && name != ".." {
+				return true
+			}
+		case name == entry || strings.HasPrefix(name, entry+"/"):
+			return true
+		}
+	}
+	return false
+}
+
+// Literals returns the include entries that name a single file
+// rather than a glob.
+func (s *fileSpec) Literals() []string {
+	var literals []string
+	for _, entry := range s.include {
+		if !hasGlobMeta(entry) {
+			literals = append(literals, entry)
+		}
+	}
+	return literals
+}
+
+// globPrefix returns the leading directories of pattern that contain
+// no glob metacharacters, or "." if there are none.
+func globPrefix(pattern string) string {
+	parts := strings.Split(pattern, "/")
+	var prefix []string
+	for _, part := range parts[:len(parts)-1] {
+		if hasGlobMeta(part) {
+			break
+		}
+		prefix = append(prefix, part)
+	}
+	if len(prefix) == 0 {
+		return "."
+	}
+	return strings.Join(prefix, "/")
+}
+
+// walkFiles returns the files below dir as slash-separated paths
+// relative to basePath, in lexical order.  Files and directories
+// matched by ignore are skipped, as are symlinks leading out of
+// rootPath.
+func walkFiles(store Store, dir, basePath, rootPath string, ignore *IgnoreList) ([]string, error) {
+	absBase, err := filepath.Abs(basePath)
+	if err != nil {
+		return nil, err
+	}
+	absRoot, err := filepath.Abs(rootPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	err = walkStore(store, dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if p == dir && os.IsNotExist(err) {
+				// a glob whose directory doesn't exist matches nothing
+				return nil
+			}
+			return err
+		}
+		relRoot, err := filepath.Rel(absRoot, p)
+		if err != nil {
+			return err
+		}
+		if p != dir && ignore.Match(filepath.ToSlash(relRoot), fi.IsDir()) {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if _, err := resolvePath(store, absRoot, absRoot, p); err != nil {
+				log.Printf("Warning: skipping %s: %v", p, err)
+				return nil
+			}
+		}
+		rel, err := filepath.Rel(absBase, p)
+		if err != nil {
+			return err
+		}
+		names = append(names, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error walking %s: %v", dir, err)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// matchGlob reports whether the slash-separated name matches pattern.
+// Each path segment is matched with path.Match, except that a `**`
+// segment matches zero or more whole segments.
+func matchGlob(pattern, name string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(patterns, names []string) bool {
+	for len(patterns) > 0 {
+		if patterns[0] == "**" {
+			patterns = patterns[1:]
+			if len(patterns) == 0 {
+				return true
+			}
+			for i := 0; i <= len(names); i++ {
+				if matchSegments(patterns, names[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(names) == 0 {
+			return false
+		}
+		ok, err := path.Match(patterns[0], names[0])
+		if err != nil || !ok {
+			return false
+		}
+		patterns, names = patterns[1:], names[1:]
+	}
+	return len(names) == 0
+}
@@ -0,0 +1,130 @@
+package tree
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		{"*.go", "main.go", true},
+		{"*.go", "cmd/main.go", false},
+		{"cmd/**/*.go", "cmd/main.go", true},
+		{"cmd/**/*.go", "cmd/aidss/main.go", true},
+		{"cmd/**/*.go", "llm/llm.go", false},
+		{"**/*_test.go", "cmd/aidss/main_test.go", true},
+		{"llm/*.go", "llm/mock.go", true},
+		{"llm/*.go", "llm/sub/mock.go", false},
+		{"doc/**", "doc/a/b.txt", true},
+	}
+	for _, tt := range tests {
+		got := matchGlob(tt.pattern, tt.name)
+		if got != tt.want {
+			t.Errorf("matchGlob(%q, %q): expected %v, got %v", tt.pattern, tt.name, tt.want, got)
+		}
+	}
+}
+
+// mkFiles creates the named files, and their directories, below dir.
+func mkFiles(t *testing.T, dir string, names ...string) {
+	for _, name := range names {
+		absPath := filepath.Join(dir, filepath.FromSlash(name))
+		err := os.MkdirAll(filepath.Dir(absPath), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(absPath, []byte(name), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFileSpecExpand(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "test_file_spec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootDir)
+
+	mkFiles(t, rootDir,
+		"cmd/aidss/main.go",
+		"cmd/aidss/main_test.go",
+		"cmd/aidss/testdata/x.go",
+		"llm/llm.go",
+		"llm/mock.go",
+		"llm/README.md",
+		"doc/a.txt",
+		"doc/sub/b.txt",
+		"go.mod",
+	)
+
+	ignore := &IgnoreList{}
+	ignore.parseIgnoreLines([]string{"testdata/", "go.*"}, "")
+
+	tests := []struct {
+		entries []string
+		want    []string
+	}{
+		{
+			[]string{"cmd/**/*.go", "llm/*.go"},
+			[]string{"cmd/aidss/main.go", "cmd/aidss/main_test.go", "llm/llm.go", "llm/mock.go"},
+		},
+		{
+			[]string{"cmd/**/*.go", "!*_test.go"},
+			[]string{"cmd/aidss/main.go"},
+		},
+		{
+			[]string{"doc"},
+			[]string{"doc/a.txt", "doc/sub/b.txt"},
+		},
+		{
+			[]string{"doc", "!doc/sub/"},
+			[]string{"doc/a.txt"},
+		},
+		{
+			// ignored files are skipped by globs, but literal names
+			// are always kept
+			[]string{"*", "go.mod", "missing.txt"},
+			[]string{"go.mod", "missing.txt"},
+		},
+	}
+	for _, tt := range tests {
+		got, err := newFileSpec(tt.entries).Expand(OS, rootDir, rootDir, ignore)
+		if err != nil {
+			t.Errorf("Expand(%v): expected no error, got %v", tt.entries, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Expand(%v): expected %v, got %v", tt.entries, tt.want, got)
+		}
+	}
+}
+
+func TestFileSpecAllows(t *testing.T) {
+	spec := newFileSpec([]string{"cmd/**/*.go", "!*_test.go", "doc", "README.md"})
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"cmd/aidss/main.go", true},
+		{"cmd/aidss/main_test.go", false},
+		{"doc/new/file.txt", true},
+		{"./README.md", true},
+		{"llm/llm.go", false},
+		{"documents.txt", false},
+	}
+	for _, tt := range tests {
+		got := spec.Allows(tt.name)
+		if got != tt.want {
+			t.Errorf("Allows(%q): expected %v, got %v", tt.name, tt.want, got)
+		}
+	}
+}
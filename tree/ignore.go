@@ -0,0 +1,217 @@
+package tree
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// defaultIgnores are ignored whether or not an ignore file lists them.
+var defaultIgnores = []string{".git/"}
+
+// ignoreRule is a single line of an ignore file.
+type ignoreRule struct {
+	pattern  string
+	base     string // directory the rule is relative to, "" for the root
+	negate   bool   // line started with `!`
+	dirOnly  bool   // line ended with `/`
+	anchored bool   // pattern contains a `/`, so it is relative to base
+}
+
+// IgnoreList is an ordered list of gitignore-style rules.  Paths
+// passed to Match are slash-separated and relative to the directory
+// the list applies to.
+type IgnoreList struct {
+	rules []ignoreRule
+}
+
+// parseIgnoreLines adds the rules in lines to the list.  Rules are
+// relative to base, a slash-separated directory, or "" for the
+// directory the list applies to.
+func (l *IgnoreList) parseIgnoreLines(lines []string, base string) {
+	for _, line := range lines {
+		line = strings.TrimRight(line, " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule := ignoreRule{base: base}
+		if strings.HasPrefix(line, "!") {
+			rule.negate = true
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		if strings.Contains(line, "/") {
+			rule.anchored = true
+			line = strings.TrimPrefix(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+		rule.pattern = line
+		l.rules = append(l.rules, rule)
+	}
+}
+
+// loadIgnoreFile adds the rules in the named file to the list.  A
+// missing file is not an error.
+func (l *IgnoreList) loadIgnoreFile(store Store, filename, base string) error {
+	data, err := store.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	lines := strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n")
+	l.parseIgnoreLines(lines, base)
+	return nil
+}
+
+// LoadIgnoreRules returns the ignore rules for a project: the
+// defaults, then .gitignore at the project root and, as git does, the
+// .gitignore files of the directories below it that aren't ignored,
+// then .aidssignore at the project root and the ignore file in the
+// watch path.  Rules are relative to the project root, or to the
+// directory of the .gitignore they come from.
+func LoadIgnoreRules(store Store, rootPath, watchPath string) (*IgnoreList, error) {
+	l := &IgnoreList{}
+	l.parseIgnoreLines(defaultIgnores, "")
+	err := l.loadIgnoreFile(store, filepath.Join(rootPath, GitIgnoreFn), "")
+	if err != nil {
+		return nil, err
+	}
+	err = l.loadNestedGitIgnores(store, rootPath)
+	if err != nil {
+		return nil, err
+	}
+	filenames := []string{
+		filepath.Join(rootPath, AidssIgnoreFn),
+		filepath.Join(watchPath, IgnoreFn),
+	}
+	for _, filename := range filenames {
+		err := l.loadIgnoreFile(store, filename, "")
+		if err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// loadNestedGitIgnores adds the rules in the .gitignore files of the
+// directories below rootPath, parents before children, skipping the
+// directories ignored by the rules loaded so far.  Directories that
+// can't be read are skipped.
+func (l *IgnoreList) loadNestedGitIgnores(store Store, rootPath string) error {
+	return walkStore(store, rootPath, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.IsDir() {
+			return nil
+		}
+		if p == rootPath {
+			return nil
+		}
+		rel, err := filepath.Rel(rootPath, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if l.Match(rel, true) {
+			return filepath.SkipDir
+		}
+		return l.loadIgnoreFile(store, filepath.Join(p, GitIgnoreFn), rel)
+	})
+}
+
+// ForWatchPath returns the rules to use when walking watchPath: l
+// plus, if the watch path itself is ignored (e.g. `.aidss/` in
+// .gitignore), a final rule re-including it, so that its subdirectories
+// are still walked.
+func (l *IgnoreList) ForWatchPath(rootPath, watchPath string) *IgnoreList {
+	if !l.IgnoredPath(rootPath, watchPath, true) {
+		return l
+	}
+	absRoot, err := filepath.Abs(rootPath)
+	if err != nil {
+		return l
+	}
+	absWatchPath, err := filepath.Abs(watchPath)
+	if err != nil {
+		return l
+	}
+	rel, err := filepath.Rel(absRoot, absWatchPath)
+	if err != nil {
+		return l
+	}
+	wl := &IgnoreList{rules: append([]ignoreRule{}, l.rules...)}
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	for i := range parts {
+		wl.parseIgnoreLines([]string{"!/" + strings.Join(parts[:i+1], "/") + "/"}, "")
+	}
+	return wl
+}
+
+// IgnoredPath reports whether the absolute or working-directory
+// relative path is ignored by l, whose rules are relative to rootPath.
+func (l *IgnoreList) IgnoredPath(rootPath, path string, isDir bool) bool {
+	absRoot, err := filepath.Abs(rootPath)
+	if err != nil {
+		return false
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(absRoot, absPath)
+	if err != nil || rel == "." {
+		return false
+	}
+	return l.Match(filepath.ToSlash(rel), isDir)
+}
+
+// Match reports whether rel is ignored, either directly or because
+// one of its parent directories is.  The last matching rule wins, as
+// in gitignore.
+func (l *IgnoreList) Match(rel string, isDir bool) bool {
+	if l == nil || len(l.rules) == 0 {
+		return false
+	}
+	rel = path.Clean(strings.TrimPrefix(rel, "./"))
+	parts := strings.Split(rel, "/")
+	for i := 1; i < len(parts); i++ {
+		if l.matchOne(strings.Join(parts[:i], "/"), true) {
+			return true
+		}
+	}
+	return l.matchOne(rel, isDir)
+}
+
+// matchOne applies the rules to rel alone, ignoring its parents.
+func (l *IgnoreList) matchOne(rel string, isDir bool) bool {
+	ignored := false
+	for _, rule := range l.rules {
+		if rule.match(rel, isDir) {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
+
+// match reports whether the rule's pattern matches rel.
+func (r ignoreRule) match(rel string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+	if r.base != "" {
+		if !strings.HasPrefix(rel, r.base+"/") {
+			return false
+		}
+		rel = strings.TrimPrefix(rel, r.base+"/")
+	}
+	if r.anchored {
+		return matchGlob(r.pattern, rel)
+	}
+	return matchGlob("**/"+r.pattern, rel)
+}
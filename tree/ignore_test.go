@@ -0,0 +1,94 @@
+package tree
+
+import (
+	"path"
+	"testing"
+)
+
+func TestIgnoreListMatch(t *testing.T) {
+	l := &IgnoreList{}
+	l.parseIgnoreLines([]string{
+		"# comment",
+		"node_modules/",
+		"*.log",
+		"!keep.log",
+		"/build",
+		"docs/*.pdf",
+	}, "")
+
+	tests := []struct {
+		rel   string
+		isDir bool
+		want  bool
+	}{
+		{"node_modules", true, true},
+		{"web/node_modules", true, true},
+		{"web/node_modules/x/index.js", false, true},
+		{"node_modules", false, false},
+		{"debug.log", false, true},
+		{"logs/debug.log", false, true},
+		{"keep.log", false, false},
+		{"build", true, true},
+		{"cmd/build", true, false},
+		{"docs/a.pdf", false, true},
+		{"docs/sub/a.pdf", false, false},
+		{"main.go", false, false},
+	}
+	for _, tt := range tests {
+		got := l.Match(tt.rel, tt.isDir)
+		if got != tt.want {
+			t.Errorf("Match(%q, %v): expected %v, got %v", tt.rel, tt.isDir, tt.want, got)
+		}
+	}
+}
+
+func TestLoadIgnoreRulesNested(t *testing.T) {
+	store := NewMemStore()
+	files := map[string]string{
+		"/project/.gitignore":        "*.log\nbuild/\n",
+		"/project/web/.gitignore":    "dist/\n/local.txt\n!keep.log\n",
+		"/project/web/app/main.js":   "",
+		"/project/vendor/.gitignore": "*.js\n",
+		"/project/build/.gitignore":  "!*.log\n",
+	}
+	for name, content := range files {
+		if err := store.MkdirAll(path.Dir(name)); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.WriteFile(name, []byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l, err := LoadIgnoreRules(store, "/project", "/project/.aidss")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		rel   string
+		isDir bool
+		want  bool
+	}{
+		// A nested .gitignore applies below its directory only
+		{"web/dist", true, true},
+		{"web/app/dist", true, true},
+		{"dist", true, false},
+		{"web/local.txt", false, true},
+		{"web/app/local.txt", false, false},
+		{"local.txt", false, false},
+		{"vendor/lib.js", false, true},
+		{"web/app/main.js", false, false},
+		// and overrides the root's
+		{"debug.log", false, true},
+		{"web/keep.log", false, false},
+		{"keep.log", false, true},
+		// A .gitignore in an ignored directory is not read
+		{"build/debug.log", false, true},
+	}
+	for _, tt := range tests {
+		got := l.Match(tt.rel, tt.isDir)
+		if got != tt.want {
+			t.Errorf("Match(%q, %v): expected %v, got %v", tt.rel, tt.isDir, tt.want, got)
+		}
+	}
+}
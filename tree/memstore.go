@@ -0,0 +1,390 @@
+package tree
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// MemStore is a Store held in memory, for tests and for embedding
+// the tree where there is no filesystem to keep it in.  It has no
+// symbolic links, and the root directory always exists.
+type MemStore struct {
+	mu       sync.Mutex
+	files    map[string]*memFile // by clean path
+	lastMod  time.Time
+	watchers []*memWatcher
+}
+
+// memFile is a file or directory in a MemStore.
+type memFile struct {
+	dir     bool
+	data    []byte
+	modTime time.Time
+}
+
+// NewMemStore returns an empty MemStore.
+func NewMemStore() *MemStore {
+	return &MemStore{files: make(map[string]*memFile)}
+}
+
+// memKey returns the key name is stored under.
+func memKey(name string) string {
+	return filepath.Clean(name)
+}
+
+// isRoot reports whether key is a root directory.
+func isRoot(key string) bool {
+	return filepath.Dir(key) == key
+}
+
+// now returns the modification time for a change, later than every
+// earlier one so that ordering by modification time is reliable.
+// Callers must hold s.mu.
+func (s *MemStore) now() time.Time {
+	t := time.Now()
+	if !t.After(s.lastMod) {
+		t = s.lastMod.Add(time.Nanosecond)
+	}
+	s.lastMod = t
+	return t
+}
+
+// lookup returns the entry for key.  Callers must hold s.mu.
+func (s *MemStore) lookup(op, key string) (*memFile, error) {
+	if isRoot(key) {
+		return &memFile{dir: true}, nil
+	}
+	f, ok := s.files[key]
+	if !ok {
+		return nil, &os.PathError{Op: op, Path: key, Err: os.ErrNotExist}
+	}
+	return f, nil
+}
+
+// ReadFile returns the content of the named file.
+func (s *MemStore) ReadFile(name string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f, err := s.lookup("open", memKey(name))
+	if err != nil {
+		return nil, err
+	}
+	if f.dir {
+		return nil, &os.PathError{Op: "read", Path: name, Err: syscall.EISDIR}
+	}
+	return append([]byte(nil), f.data...), nil
+}
+
+// WriteFile replaces the named file's content.  Its directory must
+// exist.
+func (s *MemStore) WriteFile(name string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := memKey(name)
+	parent, err := s.lookup("open", filepath.Dir(key))
+	if err != nil {
+		return &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	if !parent.dir {
+		return &os.PathError{Op: "open", Path: name, Err: syscall.ENOTDIR}
+	}
+	op := fsnotify.Write
+	if f, ok := s.files[key]; !ok {
+		op = fsnotify.Create
+	} else if f.dir {
+		return &os.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+	}
+	s.files[key] = &memFile{data: append([]byte(nil), data...), modTime: s.now()}
+	s.notify(key, op)
+	return nil
+}
+
+// WriteFileAtomic replaces the named file's content; every write to a
+// MemStore is atomic.
+func (s *MemStore) WriteFileAtomic(name string, data []byte) error {
+	return s.WriteFile(name, data)
+}
+
+// Remove removes the named file or empty directory.
+func (s *MemStore) Remove(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := memKey(name)
+	f, err := s.lookup("remove", key)
+	if err != nil {
+		return err
+	}
+	if f.dir {
+		for other := range s.files {
+			if filepath.Dir(other) == key {
+				return &os.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+			}
+		}
+	}
+	delete(s.files, key)
+	s.notify(key, fsnotify.Remove)
+	return nil
+}
+
+// Stat describes the named file.
+func (s *MemStore) Stat(name string) (os.FileInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := memKey(name)
+	f, err := s.lookup("stat", key)
+	if err != nil {
+		return nil, err
+	}
+	return memFileInfo{name: filepath.Base(key), file: f}, nil
+}
+
+// Lstat describes the named file; a MemStore has no links.
+func (s *MemStore) Lstat(name string) (os.FileInfo, error) {
+	return s.Stat(name)
+}
+
+// ReadDir lists the entries of the named directory, sorted by name.
+func (s *MemStore) ReadDir(name string) ([]os.FileInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := memKey(name)
+	f, err := s.lookup("open", key)
+	if err != nil {
+		return nil, err
+	}
+	if !f.dir {
+		return nil, &os.PathError{Op: "readdirent", Path: name, Err: syscall.ENOTDIR}
+	}
+	var entries []os.FileInfo
+	for other, f := range s.files {
+		if filepath.Dir(other) == key && other != key {
+			entries = append(entries, memFileInfo{name: filepath.Base(other), file: f})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// MkdirAll creates the named directory and any missing parents.
+func (s *MemStore) MkdirAll(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := memKey(name)
+	var missing []string
+	for !isRoot(key) {
+		f, ok := s.files[key]
+		if ok {
+			if !f.dir {
+				return &os.PathError{Op: "mkdir", Path: key, Err: syscall.ENOTDIR}
+			}
+			break
+		}
+		missing = append(missing, key)
+		key = filepath.Dir(key)
+	}
+	for i := len(missing) - 1; i >= 0; i-- {
+		s.files[missing[i]] = &memFile{dir: true, modTime: s.now()}
+		s.notify(missing[i], fsnotify.Create)
+	}
+	return nil
+}
+
+// EvalSymlinks returns the clean name; a MemStore has no links.
+func (s *MemStore) EvalSymlinks(name string) (string, error) {
+	_, err := s.Stat(name)
+	if err != nil {
+		return "", err
+	}
+	return memKey(name), nil
+}
+
+// Watch returns a watcher told of every change made to the store.
+func (s *MemStore) Watch() (Watcher, error) {
+	w := &memWatcher{
+		store:  s,
+		dirs:   make(map[string]bool),
+		events: make(chan fsnotify.Event),
+		errors: make(chan error),
+		done:   make(chan struct{}),
+	}
+	w.cond = sync.NewCond(&w.mu)
+	s.mu.Lock()
+	s.watchers = append(s.watchers, w)
+	s.mu.Unlock()
+	go w.run()
+	return w, nil
+}
+
+// notify tells the watchers of the change to key.  Callers must hold
+// s.mu.
+func (s *MemStore) notify(key string, op fsnotify.Op) {
+	for _, w := range s.watchers {
+		w.queue(fsnotify.Event{Name: key, Op: op})
+	}
+}
+
+// memFileInfo describes a file in a MemStore.
+type memFileInfo struct {
+	name string
+	file *memFile
+}
+
+func (fi memFileInfo) Name() string       { return fi.name }
+func (fi memFileInfo) Size() int64        { return int64(len(fi.file.data)) }
+func (fi memFileInfo) ModTime() time.Time { return fi.file.modTime }
+func (fi memFileInfo) IsDir() bool        { return fi.file.dir }
+func (fi memFileInfo) Sys() interface{}   { return nil }
+
+func (fi memFileInfo) Mode() os.FileMode {
+	if fi.file.dir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+// memWatcher is the Watcher of a MemStore.  Events are queued without
+// limit, so that changes made while handling an event don't block.
+type memWatcher struct {
+	store  *MemStore
+	events chan fsnotify.Event
+	errors chan error
+	done   chan struct{}
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	dirs    map[string]bool
+	pending []fsnotify.Event
+	closed  bool
+}
+
+// queue queues event if it is for an entry of a watched directory.
+func (w *memWatcher) queue(event fsnotify.Event) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed || !w.dirs[filepath.Dir(event.Name)] {
+		return
+	}
+	w.pending = append(w.pending, event)
+	w.cond.Signal()
+}
+
+// run delivers the queued events until the watcher is closed.
+func (w *memWatcher) run() {
+	defer close(w.errors)
+	defer close(w.events)
+	for {
+		w.mu.Lock()
+		for len(w.pending) == 0 && !w.closed {
+			w.cond.Wait()
+		}
+		if w.closed {
+			w.mu.Unlock()
+			return
+		}
+		event := w.pending[0]
+		w.pending = w.pending[1:]
+		w.mu.Unlock()
+
+		select {
+		case w.events <- event:
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// Add watches dir, which must exist.
+func (w *memWatcher) Add(dir string) error {
+	fi, err := w.store.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s: not a directory", dir)
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.dirs[memKey(dir)] = true
+	return nil
+}
+
+// Remove stops watching dir.
+func (w *memWatcher) Remove(dir string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	key := memKey(dir)
+	if !w.dirs[key] {
+		return fmt.Errorf("%w: %s", fsnotify.ErrNonExistentWatch, dir)
+	}
+	delete(w.dirs, key)
+	return nil
+}
+
+// WatchList returns the directories watched.
+func (w *memWatcher) WatchList() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var dirs []string
+	for dir := range w.dirs {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	return dirs
+}
+
+// Events returns the channel of events.
+func (w *memWatcher) Events() <-chan fsnotify.Event {
+	return w.events
+}
+
+// Errors returns the channel of errors.
+func (w *memWatcher) Errors() <-chan error {
+	return w.errors
+}
+
+// Close stops watching and closes the channels.
+func (w *memWatcher) Close() error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return nil
+	}
+	w.closed = true
+	close(w.done)
+	w.cond.Signal()
+	w.mu.Unlock()
+
+	s := w.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, other := range s.watchers {
+		if other == w {
+			s.watchers = append(s.watchers[:i], s.watchers[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// String lists the store's files, for test failures.
+func (s *MemStore) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var names []string
+	for name, f := range s.files {
+		if f.dir {
+			name += "/"
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, "\n")
+}
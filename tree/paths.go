@@ -0,0 +1,183 @@
+package tree
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// ProjectRoot returns the default project root for a watch path: the
+// parent of the watch path.  This lets messages live in e.g.
+// ~/lab/foo/.aidss/round1/ while the files they refer to live in
+// ~/lab/foo.
+func ProjectRoot(watchPath string) (string, error) {
+	absWatchPath, err := filepath.Abs(watchPath)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Dir(absWatchPath), nil
+}
+
+// promptBasePath returns the directory that the prompt's In and Out
+// files are relative to.  This is the project root unless the prompt
+// has a Root: header, which is itself relative to the project root and
+// may not leave it.
+func promptBasePath(store Store, prompt *Prompt, rootPath string) (string, error) {
+	if prompt.Root == "" {
+		return filepath.Abs(rootPath)
+	}
+	return resolvePath(store, rootPath, rootPath, prompt.Root)
+}
+
+// resolvePath resolves name against base and returns the absolute
+// path.  It returns an error if the result lies outside root, either
+// lexically (absolute paths, `..` components) or after following any
+// symlinks in the part of the path that already exists.
+func resolvePath(store Store, rootPath, base, name string) (string, error) {
+	if strings.TrimSpace(name) == "" {
+		return "", fmt.Errorf("empty filename")
+	}
+	absRoot, err := filepath.Abs(rootPath)
+	if err != nil {
+		return "", err
+	}
+	realRoot, err := store.EvalSymlinks(absRoot)
+	if err != nil {
+		return "", err
+	}
+
+	absPath := name
+	if !filepath.IsAbs(absPath) {
+		absPath = filepath.Join(base, absPath)
+	}
+	absPath, err = filepath.Abs(absPath)
+	if err != nil {
+		return "", err
+	}
+	if !IsWithin(absRoot, absPath) {
+		return "", fmt.Errorf("%s: outside project root %s", name, absRoot)
+	}
+
+	realPath, err := evalExistingSymlinks(store, absPath)
+	if err != nil {
+		return "", err
+	}
+	if !IsWithin(realRoot, realPath) {
+		return "", fmt.Errorf("%s: resolves outside project root %s", name, absRoot)
+	}
+	return absPath, nil
+}
+
+// evalExistingSymlinks evaluates symlinks in the longest existing
+// prefix of path and appends the remaining, not yet existing,
+// components unchanged.
+func evalExistingSymlinks(store Store, path string) (string, error) {
+	var rest []string
+	current := path
+	for {
+		_, err := store.Lstat(current)
+		if err == nil {
+			break
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		parent := filepath.Dir(current)
+		if parent == current {
+			break
+		}
+		rest = append([]string{filepath.Base(current)}, rest...)
+		current = parent
+	}
+	realPath, err := store.EvalSymlinks(current)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(append([]string{realPath}, rest...)...), nil
+}
+
+// IsWithin reports whether path is rootPath or lies below it.  Both
+// paths must be absolute and clean.
+func IsWithin(rootPath, path string) bool {
+	rel, err := filepath.Rel(rootPath, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// tempFiles holds the temporary files of writes under way, for
+// RemoveTempFiles.
+var (
+	tempFiles      = make(map[string]bool)
+	tempFilesMutex sync.Mutex
+)
+
+// WriteFileAtomic replaces the named file with data by writing a
+// temporary file, flushing it to disk and renaming it into place, so
+// that readers, such as jobs on other nodes, never see a partial file.
+func WriteFileAtomic(name string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(name), filepath.Base(name)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tempFilesMutex.Lock()
+	tempFiles[tmp.Name()] = true
+	tempFilesMutex.Unlock()
+	defer func() {
+		tempFilesMutex.Lock()
+		delete(tempFiles, tmp.Name())
+		tempFilesMutex.Unlock()
+	}()
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("error writing %s: %v", tmp.Name(), err)
+	}
+	err = os.Rename(tmp.Name(), name)
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("error renaming %s: %v", tmp.Name(), err)
+	}
+	return nil
+}
+
+// RemoveTempFiles removes the temporary files of writes that haven't
+// finished, so that a daemon exiting mid-write leaves none behind.
+func RemoveTempFiles() {
+	tempFilesMutex.Lock()
+	defer tempFilesMutex.Unlock()
+	for name := range tempFiles {
+		err := os.Remove(name)
+		if err != nil && !os.IsNotExist(err) {
+			log.Println("Error removing temporary file:", err)
+		}
+		delete(tempFiles, name)
+	}
+}
+
+// FileHash returns the SHA-256 of the file's content, in hex.
+func FileHash(name string) (string, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
@@ -0,0 +1,211 @@
+package tree
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stevegt/aidss/llm"
+)
+
+func TestResolvePath(t *testing.T) {
+	outsideDir, err := ioutil.TempDir("", "test_resolve_outside")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outsideDir)
+
+	rootDir, err := ioutil.TempDir("", "test_resolve_root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootDir)
+
+	nodeDir := filepath.Join(rootDir, ".aidss", "round1")
+	err = os.MkdirAll(nodeDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Symlink(outsideDir, filepath.Join(rootDir, "escape"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		want string
+		ok   bool
+	}{
+		{"notes.txt", filepath.Join(nodeDir, "notes.txt"), true},
+		{"../../doc/ideas.txt", filepath.Join(rootDir, "doc", "ideas.txt"), true},
+		{"../../../etc/hosts", "", false},
+		{"/etc/hosts", "", false},
+		{filepath.Join(rootDir, "main.go"), filepath.Join(rootDir, "main.go"), true},
+		{"../../escape/secret.txt", "", false},
+		{"../../escape/new/dir/file.txt", "", false},
+		{"", "", false},
+	}
+
+	for _, tt := range tests {
+		got, err := resolvePath(OS, rootDir, nodeDir, tt.name)
+		if tt.ok && err != nil {
+			t.Errorf("resolvePath(OS, %q): expected no error, got %v", tt.name, err)
+			continue
+		}
+		if !tt.ok {
+			if err == nil {
+				t.Errorf("resolvePath(OS, %q): expected error, got %s", tt.name, got)
+			}
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("resolvePath(OS, %q): expected %s, got %s", tt.name, tt.want, got)
+		}
+	}
+}
+
+func TestProcessLLMResponseConfinement(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "test_response_confinement")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootDir)
+
+	nodeDir := filepath.Join(rootDir, "node")
+	err = os.Mkdir(nodeDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A file the model sends without it being listed in Out: must not
+	// be written
+	response := `<OUT filename="listed.txt">
+listed
+</OUT>
+<OUT filename="unlisted.txt">
+unlisted
+</OUT>`
+	err = processLLMResponse(OS, response, []string{"listed.txt"}, nodeDir, rootDir)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(nodeDir, "listed.txt")); err != nil {
+		t.Errorf("Expected listed.txt to be written, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(nodeDir, "unlisted.txt")); !os.IsNotExist(err) {
+		t.Errorf("Expected unlisted.txt not to be written, got %v", err)
+	}
+
+	// An Out: entry escaping the root is an error, and nothing is
+	// written
+	response = `<OUT filename="ok.txt">
+ok
+</OUT>
+<OUT filename="../../escape.txt">
+escape
+</OUT>`
+	err = processLLMResponse(OS, response, []string{"ok.txt", "../../escape.txt"}, nodeDir, rootDir)
+	if err == nil {
+		t.Fatalf("Expected error for Out file outside root")
+	}
+	if _, err := os.Stat(filepath.Join(nodeDir, "ok.txt")); !os.IsNotExist(err) {
+		t.Errorf("Expected ok.txt not to be written, got %v", err)
+	}
+}
+
+func TestHandleUserMessageProjectRoot(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "test_project_root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootDir)
+
+	watchDir := filepath.Join(rootDir, ".aidss")
+	nodeDir := filepath.Join(watchDir, "round1", "round2")
+	err = os.MkdirAll(nodeDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.MkdirAll(filepath.Join(rootDir, "doc", "sub"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(rootDir, "doc", "ideas.txt"), []byte("Some ideas"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(rootDir, "doc", "sub", "more.txt"), []byte("More ideas"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := llm.NewClient("mock-model")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		prompt   string
+		filename string
+		content  string
+	}{
+		// In files are relative to the parent of the watch path
+		{"In: doc/ideas.txt\n\nWhat do you think?", "doc/ideas.txt", "Some ideas"},
+		// Root: moves the base within the project root
+		{"In: sub/more.txt\nRoot: doc\n\nWhat do you think?", "sub/more.txt", "More ideas"},
+	}
+
+	for _, c := range cases {
+		err = ioutil.WriteFile(filepath.Join(nodeDir, "prompt.txt"), []byte(c.prompt), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		handleUserMessage(context.Background(), OS, nodeDir, client, watchDir, rootDir)
+
+		data, err := ioutil.ReadFile(filepath.Join(nodeDir, "prompt-full.txt"))
+		if err != nil {
+			t.Fatalf("Expected prompt-full.txt to be created, got error: %v", err)
+		}
+		expected := "<IN filename=\"" + c.filename + "\">\n" + c.content + "\n</IN>"
+		if !strings.Contains(string(data), expected) {
+			t.Errorf("Expected prompt-full.txt to contain %q, got %q", expected, string(data))
+		}
+	}
+}
+
+func TestRemoveTempFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_tempfiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	name := filepath.Join(dir, "file.txt")
+	err = WriteFileAtomic(name, []byte("data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A write cut short by shutdown leaves its temporary file
+	// registered until RemoveTempFiles
+	tmp := name + ".123.tmp"
+	err = ioutil.WriteFile(tmp, []byte("partial"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tempFilesMutex.Lock()
+	tempFiles[tmp] = true
+	tempFilesMutex.Unlock()
+
+	RemoveTempFiles()
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name() != "file.txt" {
+		t.Errorf("Expected only file.txt to remain, got %v", files)
+	}
+}
@@ -0,0 +1,255 @@
+package tree
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// mtimeSlop is how recently a file must have been modified for the
+// polling watcher to compare its content as well as its size and
+// modification time.  Network filesystems may keep modification times
+// to the second or coarser, so a save soon after the last one can
+// leave both unchanged.
+const mtimeSlop = 2 * time.Second
+
+// entryState is what the polling watcher knows of a directory entry.
+type entryState struct {
+	isDir   bool
+	size    int64
+	modTime time.Time
+	recent  bool   // modified within mtimeSlop of the scan
+	hash    string // content hash, for recently modified files
+}
+
+// pollWatcher is a Watcher that scans its directories every interval,
+// for filesystems that don't deliver kernel notifications, such as
+// NFS, SMB, some FUSE mounts and bind-mounted container volumes.
+// Changes are reported as Create, Write and Remove events; a rename
+// shows up as a Remove of the old name and a Create of the new.
+type pollWatcher struct {
+	interval time.Duration
+	events   chan fsnotify.Event
+	errors   chan error
+	done     chan struct{}
+	stopped  chan struct{}
+
+	mu   sync.Mutex
+	dirs map[string]map[string]entryState // entries by name, by directory
+}
+
+// newPollWatcher returns a polling watcher scanning every interval.
+func newPollWatcher(interval time.Duration) *pollWatcher {
+	if interval <= 0 {
+		interval = DefaultPollInterval
+	}
+	w := &pollWatcher{
+		interval: interval,
+		events:   make(chan fsnotify.Event),
+		errors:   make(chan error),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+		dirs:     make(map[string]map[string]entryState),
+	}
+	go w.run()
+	return w
+}
+
+// Add watches dir, taking its current entries as the starting point.
+func (w *pollWatcher) Add(dir string) error {
+	dir = filepath.Clean(dir)
+	entries, err := scanDir(dir, nil)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.dirs[dir]; !ok {
+		w.dirs[dir] = entries
+	}
+	return nil
+}
+
+// Remove stops watching dir.
+func (w *pollWatcher) Remove(dir string) error {
+	dir = filepath.Clean(dir)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if _, ok := w.dirs[dir]; !ok {
+		return fmt.Errorf("%w: %s", fsnotify.ErrNonExistentWatch, dir)
+	}
+	delete(w.dirs, dir)
+	return nil
+}
+
+// WatchList returns the directories watched.
+func (w *pollWatcher) WatchList() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var dirs []string
+	for dir := range w.dirs {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	return dirs
+}
+
+// Events returns the channel of events.
+func (w *pollWatcher) Events() <-chan fsnotify.Event {
+	return w.events
+}
+
+// Errors returns the channel of errors.
+func (w *pollWatcher) Errors() <-chan error {
+	return w.errors
+}
+
+// Close stops scanning and closes the channels.
+func (w *pollWatcher) Close() error {
+	select {
+	case <-w.done:
+		return nil
+	default:
+	}
+	close(w.done)
+	<-w.stopped
+	return nil
+}
+
+// run scans every interval until the watcher is closed.
+func (w *pollWatcher) run() {
+	defer close(w.stopped)
+	defer close(w.errors)
+	defer close(w.events)
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+		}
+		events, errs := w.scan()
+		for _, event := range events {
+			select {
+			case w.events <- event:
+			case <-w.done:
+				return
+			}
+		}
+		for _, err := range errs {
+			select {
+			case w.errors <- err:
+			case <-w.done:
+				return
+			}
+		}
+	}
+}
+
+// scan compares each watched directory with what was seen last time,
+// returning the events for the differences.  The events are sent by
+// the caller, after the lock is released, so that the receiver can
+// call Add and Remove while handling them.
+func (w *pollWatcher) scan() ([]fsnotify.Event, []error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var dirs []string
+	for dir := range w.dirs {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+
+	var events []fsnotify.Event
+	var errs []error
+	for _, dir := range dirs {
+		old := w.dirs[dir]
+		entries, err := scanDir(dir, old)
+		if os.IsNotExist(err) {
+			// Its parent reports the removal, as with inotify
+			delete(w.dirs, dir)
+			continue
+		}
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		events = append(events, diffEntries(dir, old, entries)...)
+		w.dirs[dir] = entries
+	}
+	return events, errs
+}
+
+// scanDir reads the state of dir's entries.  The content of files
+// modified within mtimeSlop is hashed, and so is that of files that
+// were on the previous scan, old, so that a save caught between two
+// scans is seen even if it left the size and modification time as
+// they were.
+func scanDir(dir string, old map[string]entryState) (map[string]entryState, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	entries := make(map[string]entryState, len(files))
+	for _, fi := range files {
+		state := entryState{isDir: fi.IsDir(), size: fi.Size(), modTime: fi.ModTime()}
+		state.recent = now.Sub(state.modTime) < mtimeSlop
+		if !state.isDir && (state.recent || old[fi.Name()].recent) {
+			hash, err := FileHash(filepath.Join(dir, fi.Name()))
+			if err == nil {
+				state.hash = hash
+			}
+		}
+		entries[fi.Name()] = state
+	}
+	return entries, nil
+}
+
+// diffEntries returns the events that turn old into entries, the
+// states of dir's entries on two scans, in name order.
+func diffEntries(dir string, old, entries map[string]entryState) []fsnotify.Event {
+	var names []string
+	for name := range old {
+		names = append(names, name)
+	}
+	for name := range entries {
+		if _, ok := old[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var events []fsnotify.Event
+	for _, name := range names {
+		before, existed := old[name]
+		after, exists := entries[name]
+		event := fsnotify.Event{Name: filepath.Join(dir, name)}
+		switch {
+		case !exists:
+			event.Op = fsnotify.Remove
+		case !existed:
+			event.Op = fsnotify.Create
+		case before.isDir != after.isDir:
+			// replaced by a different kind of entry
+			events = append(events, fsnotify.Event{Name: event.Name, Op: fsnotify.Remove})
+			event.Op = fsnotify.Create
+		case after.isDir:
+			continue
+		case before.size != after.size || !before.modTime.Equal(after.modTime):
+			event.Op = fsnotify.Write
+		case before.hash != "" && after.hash != "" && before.hash != after.hash:
+			event.Op = fsnotify.Write
+		default:
+			continue
+		}
+		events = append(events, event)
+	}
+	return events
+}
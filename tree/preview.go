@@ -0,0 +1,69 @@
+package tree
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/stevegt/aidss/llm"
+)
+
+// Preview writes to w what asking the node of model would send, with
+// per-message token counts and the estimated cost.  Nothing is sent or
+// written.
+func (n *Node) Preview(w io.Writer, model llm.Model) error {
+	return previewNode(w, n.Tree.Store, n.Path, model, n.Tree.Path, n.Tree.Root)
+}
+
+// previewNode writes to w exactly what handleUserMessage would send
+// for the node at path, with per-message token counts and the
+// estimated cost, without calling the model or writing to the node.
+// Summaries that compaction would need and can't find up to date are
+// left out rather than generated.
+func previewNode(w io.Writer, store Store, path string, model llm.Model, watchPath, rootPath string) error {
+	req, err := buildRequest(context.Background(), store, path, model, nil, watchPath, rootPath)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "Model: %s", model.Name)
+	if model.ContextWindow > 0 {
+		fmt.Fprintf(w, " (context window %d tokens, %d reserved for the response)", model.ContextWindow, model.MaxTokens)
+	}
+	fmt.Fprintf(w, "\n\n")
+
+	if len(req.prompt.Headers) > 0 {
+		fmt.Fprintf(w, "%s\n", req.prompt.FormatHeaders())
+	}
+	for _, warning := range req.prompt.Warnings {
+		fmt.Fprintf(w, "Warning: %s\n", warning)
+	}
+
+	total := 0
+	for i, msg := range req.messages {
+		tokens := model.CountMessageTokens(msg)
+		total += tokens
+		fmt.Fprintf(w, "=== %d: %s (%d tokens) ===\n", i+1, msg.Role, tokens)
+		fmt.Fprintf(w, "%s\n", strings.TrimRight(msg.Content, "\n"))
+	}
+	fmt.Fprintf(w, "\n")
+
+	for _, e := range req.elided {
+		rel, err := filepath.Rel(watchPath, e.path)
+		if err != nil {
+			rel = e.path
+		}
+		action := "Dropped"
+		if e.summarized {
+			action = "Summarized"
+		}
+		fmt.Fprintf(w, "%s: %s (%d tokens)\n", action, filepath.ToSlash(rel), e.tokens)
+	}
+
+	fmt.Fprintf(w, "Total: %d messages, %d tokens\n", len(req.messages), total)
+	fmt.Fprintf(w, "Estimated cost: $%.4f, up to $%.4f with a %d token response\n",
+		model.EstimateCost(total, 0), model.EstimateCost(total, model.MaxTokens), model.MaxTokens)
+	return nil
+}
@@ -0,0 +1,81 @@
+package tree
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stevegt/aidss/llm"
+)
+
+func TestPreviewNode(t *testing.T) {
+	watchDir, err := ioutil.TempDir("", "test_preview")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(watchDir)
+
+	// An answered root node and an unanswered child
+	client := &recordingClient{}
+	err = ioutil.WriteFile(filepath.Join(watchDir, PromptFn), []byte("Sysmsg: Be brief.\n\nFirst question"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handleUserMessage(context.Background(), OS, watchDir, client, watchDir, watchDir)
+	childDir := filepath.Join(watchDir, "child")
+	err = os.Mkdir(childDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(childDir, PromptFn), []byte("In: notes.md\n\nSecond question"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(watchDir, "notes.md"), []byte("Some notes"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	model := llm.Model{Name: "test-model", MaxTokens: 100, ContextWindow: 1000, CharsPerToken: 4, InputCost: 1000000}
+	var buf bytes.Buffer
+	err = previewNode(&buf, OS, childDir, model, watchDir, watchDir)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	out := buf.String()
+
+	expected := []string{
+		"Model: test-model (context window 1000 tokens",
+		"In: notes.md",
+		"=== 1: system (",
+		"Be brief.",
+		"First question",
+		"Recorded response.",
+		"=== 4: user (",
+		"Second question",
+		`<IN filename="notes.md">`,
+		"Total: 4 messages, ",
+		"Estimated cost: $",
+	}
+	for _, s := range expected {
+		if !strings.Contains(out, s) {
+			t.Errorf("Expected preview to contain %q, got:\n%s", s, out)
+		}
+	}
+
+	// Nothing is sent and nothing is written to the node
+	if len(client.calls) != 1 {
+		t.Errorf("Expected the model not to be called, got %d calls", len(client.calls))
+	}
+	files, err := ioutil.ReadDir(childDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("Expected only prompt.txt in the node, got %d files", len(files))
+	}
+}
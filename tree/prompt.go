@@ -0,0 +1,490 @@
+package tree
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Prompt is a parsed prompt file.
+type Prompt struct {
+	InFiles     []string
+	OutFiles    []string
+	Refs        []string // other nodes to include, by path or ID
+	Retrieve    []string // corpora to retrieve excerpts from
+	RetrieveTop int      // number of excerpts to retrieve, 0 for the default
+	SysMsg      string
+	Root        string
+	Status      string            // "ready" to submit the prompt in status trigger mode
+	Template    string            // name of a template in the template library
+	VarsFile    string            // file of template variables, relative to the node and within the project root
+	Vars        map[string]string // template variables from Var-name headers
+	PromptText  string
+	Notes       string   // text after the .stop line, never sent to the LLM
+	Headers     []Header // headers in effect, in the order they were applied
+	Warnings    []string // problems that don't prevent processing the prompt
+
+	setBy map[string]string // field name to the file that last replaced it
+}
+
+// Header is a single, unfolded header from a prompt file.
+type Header struct {
+	Name  string // canonical, lower case name
+	Value string // value with continuation lines joined by newlines
+	File  string
+	Line  int
+}
+
+// Location returns the file and line the header came from.
+func (h Header) Location() string {
+	return fmt.Sprintf("%s:%d", h.File, h.Line)
+}
+
+// ParseError is an error at a given line of a prompt file.
+type ParseError struct {
+	File string
+	Line int
+	Msg  string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Msg)
+}
+
+// stopLine ends the part of a prompt file that is sent to the LLM.
+const stopLine = ".stop"
+
+// SendLine, as the last non-blank line of a prompt file, submits it in
+// the daemon's marker trigger mode; it is never sent.
+const SendLine = ".send"
+
+// knownHeaders maps the canonical name of each header we understand to
+// the way it is normally written.
+var knownHeaders = map[string]string{
+	"in":           "In",
+	"in+":          "In+",
+	"out":          "Out",
+	"out+":         "Out+",
+	"ref":          "Ref",
+	"ref+":         "Ref+",
+	"retrieve":     "Retrieve",
+	"retrieve+":    "Retrieve+",
+	"retrieve-top": "Retrieve-Top",
+	"status":       "Status",
+	"sysmsg":       "Sysmsg",
+	"sysmsg+":      "Sysmsg+",
+	"root":         "Root",
+	"template":     "Template",
+	"vars":         "Vars",
+}
+
+// varHeaderPrefix starts the name of headers that set template
+// variables, as in `Var-option: Rewrite in Rust`.
+const varHeaderPrefix = "var-"
+
+// loadPrompt loads the prompt for the node at path: the headers of the
+// defaults files in watchPath and each directory down to path, in
+// that order, followed by the node's own prompt file.  Each file's
+// headers override those inherited from above, except that `In+:`,
+// `Out+:`, `Ref+:`, `Retrieve+:` and `Sysmsg+:` extend them instead.  Files are named
+// relative to path in headers and errors, e.g. ../defaults.txt.
+//
+// If the headers name a Template, the template's own headers are
+// applied after the defaults and before the prompt file's, and its
+// text is rendered to become the prompt text; see expandTemplate.  A
+// Vars file must lie within rootPath.
+func loadPrompt(store Store, path, watchPath, rootPath string) (*Prompt, error) {
+	var layers [][]Header
+	var warnings []string
+	for _, dir := range nodePaths(path, watchPath) {
+		defaultsPath := filepath.Join(dir, DefaultsFn)
+		data, err := store.ReadFile(defaultsPath)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		file, err := filepath.Rel(path, defaultsPath)
+		if err != nil {
+			return nil, err
+		}
+		lines := strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n")
+		headers, bodyStart, err := parseHeaders(file, lines)
+		if err != nil {
+			return nil, err
+		}
+		if strings.TrimSpace(strings.Join(lines[bodyStart:], "\n")) != "" {
+			warnings = append(warnings, file+": text after headers ignored")
+		}
+		layers = append(layers, headers)
+	}
+
+	data, err := store.ReadFile(filepath.Join(path, PromptFn))
+	if err != nil {
+		return nil, err
+	}
+	content := strings.ReplaceAll(string(data), "\r\n", "\n")
+	headers, body, err := parseHeaderBlock(PromptFn, content)
+	if err != nil {
+		return nil, err
+	}
+	bodyLine := strings.Count(content, "\n") - strings.Count(body, "\n") + 1
+
+	prompt := &Prompt{}
+	for _, layer := range append(layers, headers) {
+		prompt.applyHeaders(layer)
+	}
+	prompt.PromptText, prompt.Notes = splitStop(body)
+
+	var tmpl *promptTemplate
+	if prompt.Template != "" {
+		tmpl, err = loadTemplate(store, path, watchPath, prompt.Template)
+		if err != nil {
+			return nil, err
+		}
+		// Reapply everything with the template's headers slotted in
+		// between the defaults and the prompt file
+		name := prompt.Template
+		layers = append(layers, tmpl.headers, headers)
+		prompt = &Prompt{}
+		for _, layer := range layers {
+			prompt.applyHeaders(layer)
+		}
+		prompt.Template = name
+		prompt.PromptText, prompt.Notes = splitStop(body)
+	}
+	prompt.Warnings = append(warnings, prompt.Warnings...)
+
+	err = prompt.expandTemplate(store, path, watchPath, rootPath, bodyLine, tmpl)
+	if err != nil {
+		return nil, err
+	}
+	return prompt, nil
+}
+
+// ParsePromptFile parses the prompt file and returns a Prompt struct.
+// Errors are reported as *ParseError, located by the file's base name
+// and line number.
+func ParsePromptFile(filename string) (*Prompt, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePrompt(filepath.Base(filename), string(data))
+}
+
+// ParsePrompt parses the content of a prompt file.
+//
+// A prompt file is formatted like an RFC 822 message: an optional
+// block of `Name: value` headers, a blank line, and the prompt text.
+// Header names are case-insensitive.  Lines starting with a space or
+// tab continue the previous header; the newlines between them are
+// kept, so multi-line values such as Sysmsg survive intact.  Repeated
+// headers accumulate.  A file whose first line isn't a header, or
+// whose header block names no header we know, has no headers at all,
+// and is taken as prompt text in its entirety.
+func ParsePrompt(file, content string) (*Prompt, error) {
+	headers, body, err := parseHeaderBlock(file, content)
+	if err != nil {
+		return nil, err
+	}
+	prompt := &Prompt{}
+	prompt.applyHeaders(headers)
+	prompt.PromptText, prompt.Notes = splitStop(body)
+	return prompt, nil
+}
+
+// parseHeaderBlock splits the content of a prompt file into its
+// headers and its body.
+func parseHeaderBlock(file, content string) ([]Header, string, error) {
+	content = strings.ReplaceAll(content, "\r\n", "\n")
+	lines := strings.Split(content, "\n")
+
+	headers, bodyStart, err := parseHeaders(file, lines)
+	if err != nil {
+		// A first line that happens to contain a colon doesn't
+		// commit the file to having headers unless it names a header
+		// we know
+		name, _, _ := splitHeaderLine(lines[0])
+		if isKnownHeader(name) {
+			return nil, "", err
+		}
+		headers, bodyStart = nil, 0
+	}
+	if !anyKnownHeader(headers) {
+		// e.g. a one-line question like "Why: explain", or a first
+		// paragraph like "Context: we compare A and B"
+		headers, bodyStart = nil, 0
+	}
+
+	return headers, strings.Join(lines[min(bodyStart, len(lines)):], "\n"), nil
+}
+
+// parseHeaders parses the header block at the start of lines.  It
+// returns the headers and the index of the first line of the body.
+func parseHeaders(file string, lines []string) ([]Header, int, error) {
+	var headers []Header
+	for i, line := range lines {
+		lineNum := i + 1
+		switch {
+		case strings.TrimSpace(line) == "":
+			// blank line ends the headers
+			return finishHeaders(headers), i + 1, nil
+		case line[0] == ' ' || line[0] == '\t':
+			if len(headers) == 0 {
+				return nil, 0, &ParseError{file, lineNum, "continuation line before first header"}
+			}
+			h := &headers[len(headers)-1]
+			h.Value += "\n" + strings.TrimSpace(line)
+		default:
+			name, value, ok := splitHeaderLine(line)
+			if !ok {
+				return nil, 0, &ParseError{file, lineNum, fmt.Sprintf("expected header or blank line, got %q", line)}
+			}
+			headers = append(headers, Header{
+				Name:  name,
+				Value: value,
+				File:  file,
+				Line:  lineNum,
+			})
+		}
+	}
+	// headers only, no body
+	return finishHeaders(headers), len(lines), nil
+}
+
+// finishHeaders trims the newline left at the start of values whose
+// first line was empty, as in "In:\n file1\n file2".
+func finishHeaders(headers []Header) []Header {
+	for i := range headers {
+		headers[i].Value = strings.TrimLeft(headers[i].Value, "\n")
+	}
+	return headers
+}
+
+// splitHeaderLine splits a `Name: value` line, returning the
+// canonical name and the trimmed value.
+func splitHeaderLine(line string) (name, value string, ok bool) {
+	colonIndex := strings.Index(line, ":")
+	if colonIndex == -1 {
+		return "", "", false
+	}
+	name = line[:colonIndex]
+	if !isHeaderName(name) {
+		return "", "", false
+	}
+	return strings.ToLower(name), strings.TrimSpace(line[colonIndex+1:]), true
+}
+
+// isHeaderName reports whether name is a valid header name: a letter
+// followed by letters, digits, `-`, `_` or `+`.
+func isHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+		case i > 0 && (c >= '0' && c <= '9' || c == '-' || c == '_' || c == '+'):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// isKnownHeader reports whether name is the canonical name of a
+// header we understand.
+func isKnownHeader(name string) bool {
+	if _, ok := knownHeaders[name]; ok {
+		return true
+	}
+	return strings.HasPrefix(name, varHeaderPrefix) && len(name) > len(varHeaderPrefix)
+}
+
+func anyKnownHeader(headers []Header) bool {
+	for _, h := range headers {
+		if isKnownHeader(h.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// applyHeaders sets the prompt's fields from headers, in order.
+// Headers from a file other than the one that last set a field
+// replace the field's value, unless they are `+` headers; repeated
+// headers within one file accumulate.
+func (p *Prompt) applyHeaders(headers []Header) {
+	for _, h := range headers {
+		if !isKnownHeader(h.Name) {
+			p.warn(h, "unknown header %q ignored", h.Name)
+			continue
+		}
+		field := strings.TrimSuffix(h.Name, "+")
+		if p.replaces(field, h) {
+			p.clearField(field, h)
+		}
+		p.Headers = append(p.Headers, h)
+		switch field {
+		case "in":
+			p.InFiles = append(p.InFiles, strings.Fields(h.Value)...)
+		case "out":
+			p.OutFiles = append(p.OutFiles, strings.Fields(h.Value)...)
+		case "ref":
+			p.Refs = append(p.Refs, strings.Fields(h.Value)...)
+		case "retrieve":
+			p.Retrieve = append(p.Retrieve, strings.Fields(h.Value)...)
+		case "retrieve-top":
+			n, err := strconv.Atoi(strings.TrimSpace(h.Value))
+			if err != nil || n < 1 {
+				p.warn(h, "Retrieve-Top must be a positive number, got %q", h.Value)
+				continue
+			}
+			p.RetrieveTop = n
+		case "sysmsg":
+			if p.SysMsg != "" {
+				p.SysMsg += "\n"
+			}
+			p.SysMsg += h.Value
+		case "root":
+			p.Root = h.Value
+		case "status":
+			p.Status = h.Value
+		case "template":
+			p.Template = h.Value
+		case "vars":
+			p.VarsFile = h.Value
+		default:
+			if p.Vars == nil {
+				p.Vars = make(map[string]string)
+			}
+			p.Vars[strings.TrimPrefix(field, varHeaderPrefix)] = h.Value
+		}
+	}
+}
+
+// singleValued reports whether field holds a single value, so that
+// repeating it replaces rather than accumulates.
+func singleValued(field string) bool {
+	switch field {
+	case "in", "out", "ref", "retrieve", "sysmsg":
+		return false
+	}
+	return true
+}
+
+// replaces reports whether h replaces the current value of field
+// rather than adding to it.
+func (p *Prompt) replaces(field string, h Header) bool {
+	if singleValued(field) {
+		if p.setBy[field] == h.File {
+			p.warn(h, "repeated %s header replaces earlier value", headerDisplayName(h.Name))
+		}
+		return true
+	}
+	return !strings.HasSuffix(h.Name, "+") && p.setBy[field] != h.File
+}
+
+// clearField resets field and drops the headers that set it, as h is
+// about to replace them.
+func (p *Prompt) clearField(field string, h Header) {
+	if p.setBy == nil {
+		p.setBy = make(map[string]string)
+	}
+	p.setBy[field] = h.File
+	switch field {
+	case "in":
+		p.InFiles = nil
+	case "out":
+		p.OutFiles = nil
+	case "ref":
+		p.Refs = nil
+	case "retrieve":
+		p.Retrieve = nil
+	case "retrieve-top":
+		p.RetrieveTop = 0
+	case "sysmsg":
+		p.SysMsg = ""
+	case "root":
+		p.Root = ""
+	case "status":
+		p.Status = ""
+	case "template":
+		p.Template = ""
+	case "vars":
+		p.VarsFile = ""
+	default:
+		delete(p.Vars, strings.TrimPrefix(field, varHeaderPrefix))
+	}
+	var kept []Header
+	for _, old := range p.Headers {
+		if strings.TrimSuffix(old.Name, "+") != field {
+			kept = append(kept, old)
+		}
+	}
+	p.Headers = kept
+}
+
+// FormatHeaders returns the headers in effect, each preceded by a
+// comment naming the file and line it came from.
+func (p *Prompt) FormatHeaders() string {
+	var builder strings.Builder
+	for _, h := range p.Headers {
+		builder.WriteString(fmt.Sprintf("# from %s\n", h.Location()))
+		lines := strings.Split(h.Value, "\n")
+		builder.WriteString(fmt.Sprintf("%s: %s\n", headerDisplayName(h.Name), lines[0]))
+		for _, line := range lines[1:] {
+			builder.WriteString(" " + line + "\n")
+		}
+	}
+	return builder.String()
+}
+
+// headerDisplayName returns the usual spelling of the canonical header
+// name.
+func headerDisplayName(name string) string {
+	if display, ok := knownHeaders[name]; ok {
+		return display
+	}
+	if strings.HasPrefix(name, varHeaderPrefix) {
+		return "Var-" + strings.TrimPrefix(name, varHeaderPrefix)
+	}
+	return name
+}
+
+// warn records a warning about header h.
+func (p *Prompt) warn(h Header, format string, args ...interface{}) {
+	p.Warnings = append(p.Warnings, h.Location()+": "+fmt.Sprintf(format, args...))
+}
+
+// splitStop splits the body of a prompt file at the first line
+// consisting of .stop, returning the prompt text before it and the
+// notes after it.  A trailing .send marker is dropped.
+func splitStop(body string) (text, notes string) {
+	body, _ = CutSendMarker(body)
+	lines := strings.Split(body, "\n")
+	for i, line := range lines {
+		if strings.TrimSpace(line) == stopLine {
+			text = strings.Join(lines[:i], "\n")
+			notes = strings.Join(lines[i+1:], "\n")
+			return text, strings.TrimLeft(notes, "\n")
+		}
+	}
+	return body, ""
+}
+
+// CutSendMarker returns content without its last non-blank line if
+// that line is the send marker, and whether it was.
+func CutSendMarker(content string) (string, bool) {
+	trimmed := strings.TrimRight(content, " \t\r\n")
+	i := strings.LastIndex(trimmed, "\n")
+	if strings.TrimSpace(trimmed[i+1:]) != SendLine {
+		return content, false
+	}
+	return trimmed[:i+1], true
+}
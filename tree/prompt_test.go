@@ -0,0 +1,248 @@
+package tree
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stevegt/aidss/llm"
+)
+
+func TestParsePromptGrammar(t *testing.T) {
+	content := `IN: a.txt
+in: b.txt
+Out:
+ c.txt
+SYSMSG: You are a careful reviewer.
+  Answer in two parts:
+    1. summary
+Sysmsg: Be brief.
+X-Custom: whatever
+
+Prompt text.`
+
+	prompt, err := ParsePrompt(PromptFn, content)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !equalStringSlices(prompt.InFiles, []string{"a.txt", "b.txt"}) {
+		t.Errorf("Expected InFiles [a.txt b.txt], got %v", prompt.InFiles)
+	}
+	if !equalStringSlices(prompt.OutFiles, []string{"c.txt"}) {
+		t.Errorf("Expected OutFiles [c.txt], got %v", prompt.OutFiles)
+	}
+	expectedSysMsg := "You are a careful reviewer.\nAnswer in two parts:\n1. summary\nBe brief."
+	if prompt.SysMsg != expectedSysMsg {
+		t.Errorf("Expected SysMsg %q, got %q", expectedSysMsg, prompt.SysMsg)
+	}
+	if prompt.PromptText != "Prompt text." {
+		t.Errorf("Expected PromptText 'Prompt text.', got %q", prompt.PromptText)
+	}
+	expectedWarning := `prompt.txt:9: unknown header "x-custom" ignored`
+	if len(prompt.Warnings) != 1 || prompt.Warnings[0] != expectedWarning {
+		t.Errorf("Expected warning %q, got %v", expectedWarning, prompt.Warnings)
+	}
+}
+
+func TestParsePromptNoHeaders(t *testing.T) {
+	contents := []string{
+		"Just a question.\nOn two lines.",
+		"Note: this is not a header block\nbecause this line isn't a header.",
+		"Why: explain",
+		"Context: we compare A and B\n\nWhich is better?",
+	}
+	for _, content := range contents {
+		prompt, err := ParsePrompt(PromptFn, content)
+		if err != nil {
+			t.Errorf("ParsePrompt(%q): expected no error, got %v", content, err)
+			continue
+		}
+		if len(prompt.Headers) != 0 {
+			t.Errorf("ParsePrompt(%q): expected no headers, got %v", content, prompt.Headers)
+		}
+		if prompt.PromptText != content {
+			t.Errorf("ParsePrompt(%q): expected the whole file as PromptText, got %q", content, prompt.PromptText)
+		}
+	}
+}
+
+func TestParsePromptErrors(t *testing.T) {
+	tests := []struct {
+		content string
+		want    string
+	}{
+		{"In: a.txt\nOut b.txt\n\nText", `prompt.txt:2: expected header or blank line, got "Out b.txt"`},
+		{"Sysmsg: a\n bad header: x\nno colon here\n\nText", `prompt.txt:3: expected header or blank line, got "no colon here"`},
+	}
+	for _, tt := range tests {
+		_, err := ParsePrompt(PromptFn, tt.content)
+		if err == nil {
+			t.Errorf("ParsePrompt(%q): expected error", tt.content)
+			continue
+		}
+		if err.Error() != tt.want {
+			t.Errorf("ParsePrompt(%q): expected error %q, got %q", tt.content, tt.want, err.Error())
+		}
+	}
+}
+
+func TestHandleUserMessageParseError(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "test_parse_error")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	client, err := llm.NewClient("mock-model")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	promptPath := filepath.Join(tempDir, PromptFn)
+	errorPath := filepath.Join(tempDir, ErrorFn)
+
+	err = ioutil.WriteFile(promptPath, []byte("In: a.txt\nOops\n\nText"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handleUserMessage(context.Background(), OS, tempDir, client, tempDir, tempDir)
+	data, err := ioutil.ReadFile(errorPath)
+	if err != nil {
+		t.Fatalf("Expected error.txt to be created, got error: %v", err)
+	}
+	if !strings.HasPrefix(string(data), "prompt.txt:2: ") {
+		t.Errorf("Expected error.txt to start with 'prompt.txt:2: ', got %q", string(data))
+	}
+	if _, err := os.Stat(filepath.Join(tempDir, ResponseFn)); !os.IsNotExist(err) {
+		t.Errorf("Expected no response.txt, got %v", err)
+	}
+
+	// Fixing the prompt clears the error
+	err = ioutil.WriteFile(promptPath, []byte("Text"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handleUserMessage(context.Background(), OS, tempDir, client, tempDir, tempDir)
+	if _, err := os.Stat(errorPath); !os.IsNotExist(err) {
+		t.Errorf("Expected error.txt to be removed, got %v", err)
+	}
+}
+
+func TestPromptWarningsSaved(t *testing.T) {
+	store := NewMemStore()
+	if err := store.MkdirAll("/tree"); err != nil {
+		t.Fatal(err)
+	}
+	err := store.WriteFile("/tree/"+PromptFn, []byte("Sysmsg: Be brief.\nX-Custom: whatever\n\nText"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = handleUserMessage(context.Background(), store, "/tree", &recordingClient{}, "/tree", "/tree")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Ignored headers are reported alongside the request
+	data, err := store.ReadFile("/tree/" + PromptFullFn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `Warning: prompt.txt:2: unknown header "x-custom" ignored`
+	if !strings.Contains(string(data), expected) {
+		t.Errorf("Expected %q in prompt-full.txt, got %q", expected, data)
+	}
+}
+
+func TestLoadPromptInheritance(t *testing.T) {
+	watchDir, err := ioutil.TempDir("", "test_inheritance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(watchDir)
+
+	childDir := filepath.Join(watchDir, "child")
+	grandchildDir := filepath.Join(childDir, "grandchild")
+	err = os.MkdirAll(grandchildDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string]string{
+		filepath.Join(watchDir, DefaultsFn):    "In: spec.md\nOut: main.go\nSysmsg: You are an expert Go programmer.\n",
+		filepath.Join(childDir, DefaultsFn):    "In+: main.go\nSysmsg+: Keep answers short.\n",
+		filepath.Join(grandchildDir, PromptFn): "Out: main_test.go\n\nAdd tests.",
+	}
+	for fn, content := range files {
+		err = ioutil.WriteFile(fn, []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	prompt, err := loadPrompt(OS, grandchildDir, watchDir, watchDir)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !equalStringSlices(prompt.InFiles, []string{"spec.md", "main.go"}) {
+		t.Errorf("Expected InFiles [spec.md main.go], got %v", prompt.InFiles)
+	}
+	if !equalStringSlices(prompt.OutFiles, []string{"main_test.go"}) {
+		t.Errorf("Expected OutFiles [main_test.go], got %v", prompt.OutFiles)
+	}
+	expectedSysMsg := "You are an expert Go programmer.\nKeep answers short."
+	if prompt.SysMsg != expectedSysMsg {
+		t.Errorf("Expected SysMsg %q, got %q", expectedSysMsg, prompt.SysMsg)
+	}
+	if prompt.PromptText != "Add tests." {
+		t.Errorf("Expected PromptText 'Add tests.', got %q", prompt.PromptText)
+	}
+
+	expectedHeaders := `# from ../../defaults.txt:1
+In: spec.md
+# from ../../defaults.txt:3
+Sysmsg: You are an expert Go programmer.
+# from ../defaults.txt:1
+In+: main.go
+# from ../defaults.txt:2
+Sysmsg+: Keep answers short.
+# from prompt.txt:1
+Out: main_test.go
+`
+	if prompt.FormatHeaders() != expectedHeaders {
+		t.Errorf("Expected headers:\n%s\ngot:\n%s", expectedHeaders, prompt.FormatHeaders())
+	}
+}
+
+func TestCutSendMarker(t *testing.T) {
+	cases := []struct {
+		content  string
+		expected string
+		ok       bool
+	}{
+		{"Question\n.send\n", "Question\n", true},
+		{"Question\n.send", "Question\n", true},
+		{"Question\n  .send  \n\n", "Question\n", true},
+		{".send\n", "", true},
+		{"Question\n", "Question\n", false},
+		{"Question\n.send\nMore\n", "Question\n.send\nMore\n", false},
+		{"Question .send\n", "Question .send\n", false},
+	}
+	for _, c := range cases {
+		content, ok := CutSendMarker(c.content)
+		if content != c.expected || ok != c.ok {
+			t.Errorf("%q: expected %q, %v, got %q, %v", c.content, c.expected, c.ok, content, ok)
+		}
+	}
+
+	// The marker is never sent
+	prompt, err := ParsePrompt(PromptFn, "In: a.txt\n\nQuestion\n.send\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prompt.PromptText != "Question\n" {
+		t.Errorf("Expected the marker to be dropped, got %q", prompt.PromptText)
+	}
+}
@@ -0,0 +1,145 @@
+package tree
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/stevegt/aidss/llm"
+)
+
+// refMessages returns a message for each node named in the prompt's
+// Ref headers, holding that node's summary if it has an up to date
+// summary.txt, or else its response.  A ref is a path relative to the
+// watch path, or the ID that createNewDecisionNode put at the end of
+// the node's directory name (or a unique prefix of it).  Refs to the
+// node itself or to its ancestors, which are in the context already,
+// and to nodes with no response yet are skipped with a warning.
+func refMessages(store Store, prompt *Prompt, path, watchPath string) ([]TranscriptMessage, error) {
+	ancestors := make(map[string]bool)
+	for _, p := range nodePaths(path, watchPath) {
+		ancestors[filepath.Clean(p)] = true
+	}
+
+	var messages []TranscriptMessage
+	seen := make(map[string]bool)
+	for _, h := range prompt.Headers {
+		if strings.TrimSuffix(h.Name, "+") != "ref" {
+			continue
+		}
+		for _, ref := range strings.Fields(h.Value) {
+			refPath, err := resolveRef(store, ref, watchPath)
+			if err != nil {
+				return nil, fmt.Errorf("%s: Ref %s: %v", h.Location(), ref, err)
+			}
+			if ancestors[refPath] {
+				prompt.warn(h, "Ref %s is already in the context", ref)
+				continue
+			}
+			if seen[refPath] {
+				continue
+			}
+			seen[refPath] = true
+
+			kind, content, err := refContent(store, refPath)
+			if err != nil {
+				return nil, fmt.Errorf("%s: Ref %s: %v", h.Location(), ref, err)
+			}
+			if content == "" {
+				prompt.warn(h, "Ref %s has no response yet", ref)
+				continue
+			}
+			rel, err := filepath.Rel(watchPath, refPath)
+			if err != nil {
+				rel = refPath
+			}
+			messages = append(messages, TranscriptMessage{
+				Role:      llm.ChatMessageRoleUser,
+				Content:   fmt.Sprintf("For reference, the %s of another branch of this conversation, %s:\n\n%s", kind, filepath.ToSlash(rel), content),
+				Timestamp: time.Now().UTC(),
+			})
+		}
+	}
+	return messages, nil
+}
+
+// resolveRef returns the cleaned path of the node ref names: a
+// directory relative to watchPath, or else the node whose ID starts
+// with ref.
+func resolveRef(store Store, ref, watchPath string) (string, error) {
+	if !filepath.IsAbs(ref) {
+		refPath := filepath.Join(watchPath, filepath.FromSlash(ref))
+		if !IsWithin(filepath.Clean(watchPath), refPath) {
+			return "", fmt.Errorf("outside the watch path")
+		}
+		fi, err := store.Stat(refPath)
+		if err == nil && fi.IsDir() {
+			return refPath, nil
+		}
+	}
+	if strings.ContainsAny(ref, `/\`) {
+		return "", fmt.Errorf("no such node")
+	}
+	return findNodeByID(store, watchPath, ref)
+}
+
+// findNodeByID returns the node below watchPath whose ID, the part of
+// its directory name after the last `_`, starts with id.  It is an
+// error if there is no such node, or more than one.
+func findNodeByID(store Store, watchPath, id string) (string, error) {
+	var found []string
+	err := walkStore(store, watchPath, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() || p == watchPath {
+			return nil
+		}
+		if strings.HasPrefix(fi.Name(), ".") {
+			return filepath.SkipDir
+		}
+		name := fi.Name()
+		i := strings.LastIndex(name, "_")
+		if i >= 0 && strings.HasPrefix(name[i+1:], id) {
+			found = append(found, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	switch len(found) {
+	case 0:
+		return "", fmt.Errorf("no such node")
+	case 1:
+		return filepath.Clean(found[0]), nil
+	}
+	return "", fmt.Errorf("ambiguous ID matches %s and %s", found[0], found[1])
+}
+
+// refContent returns what a Ref to the node at path contributes: its
+// summary.txt if that is newer than its turn, or else its response.
+// The content is "" if the node has neither.
+func refContent(store Store, path string) (kind, content string, err error) {
+	fi, err := store.Stat(filepath.Join(path, SummaryFn))
+	if err == nil && !summaryStale(store, fi, path, []nodeHistory{{path: path}}) {
+		data, err := store.ReadFile(filepath.Join(path, SummaryFn))
+		if err != nil {
+			return "", "", err
+		}
+		return "summary", strings.TrimSpace(string(data)), nil
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return "", "", err
+	}
+
+	messages := nodeMessages(store, path)
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Role == llm.ChatMessageRoleAssistant {
+			return "response", strings.TrimSpace(messages[i].Content), nil
+		}
+	}
+	return "", "", nil
+}
@@ -0,0 +1,85 @@
+package tree
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stevegt/aidss/llm"
+)
+
+func TestRefHeader(t *testing.T) {
+	watchDir, err := ioutil.TempDir("", "test_refs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(watchDir)
+
+	client := &recordingClient{}
+	ask := func(dir, prompt string) []llm.Message {
+		err := os.MkdirAll(dir, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(filepath.Join(dir, PromptFn), []byte(prompt), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.calls = nil
+		handleUserMessage(context.Background(), OS, dir, client, watchDir, watchDir)
+		return client.lastCall()
+	}
+
+	// Two sibling branches, one made by createNewDecisionNode
+	ask(watchDir, "Root question")
+	optionA := filepath.Join(watchDir, "optionA")
+	ask(optionA, "Consider option A")
+	optionB, err := createNewDecisionNode(OS, watchDir, "Option B")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ask(optionB, "Consider option B")
+	err = ioutil.WriteFile(filepath.Join(optionB, ResponseFn), []byte("B is cheaper."), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := filepath.Base(optionB)[strings.LastIndex(filepath.Base(optionB), "_")+1:]
+
+	// Refer to one sibling by path and the other by a prefix of its ID
+	messages := ask(filepath.Join(optionA, "compare"), "Ref: optionA "+id[:8]+"\n\nCompare them")
+	var refs []string
+	for _, msg := range messages {
+		if strings.HasPrefix(msg.Content, "For reference") {
+			refs = append(refs, msg.Content)
+		}
+	}
+	if len(refs) != 1 || !strings.Contains(refs[0], "B is cheaper.") || !strings.Contains(refs[0], filepath.Base(optionB)) {
+		t.Errorf("Expected a single Ref to option B's response, got %q", refs)
+	}
+	if last := messages[len(messages)-1]; !strings.Contains(last.Content, "Compare them") {
+		t.Errorf("Expected the prompt last, got %+v", last)
+	}
+
+	// An up to date summary is used in place of the response
+	err = ioutil.WriteFile(filepath.Join(optionB, SummaryFn), []byte("Summary of B."), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages = ask(filepath.Join(watchDir, "compare2"), "Ref: "+filepath.Base(optionB)+"\n\nCompare")
+	if !strings.Contains(messages[len(messages)-2].Content, "Summary of B.") {
+		t.Errorf("Expected the summary of option B, got %+v", messages)
+	}
+
+	// A Ref to nothing is an error
+	dir := filepath.Join(watchDir, "broken")
+	if messages := ask(dir, "Ref: nosuchnode\n\nCompare"); messages != nil {
+		t.Errorf("Expected nothing to be sent, got %+v", messages)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, ErrorFn))
+	if err != nil || !strings.Contains(string(data), "prompt.txt:1: Ref nosuchnode: no such node") {
+		t.Errorf("Expected error.txt to report the bad Ref, got %q, %v", data, err)
+	}
+}
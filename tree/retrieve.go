@@ -0,0 +1,330 @@
+package tree
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// defaultRetrieveTop is the number of excerpts retrieved when the
+	// prompt has no Retrieve-Top header.
+	defaultRetrieveTop = 8
+
+	// chunkSize is the most bytes a chunk holds.
+	chunkSize = 1500
+
+	// treeCorpus is the Retrieve entry standing for the responses of
+	// the nodes outside the current branch.
+	treeCorpus = "@tree"
+
+	// BM25 parameters
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// chunk is an indexed piece of a document.
+type chunk struct {
+	Excerpt
+	terms  map[string]int // term frequencies
+	length int            // number of terms
+}
+
+// cachedChunks is a file's chunks, good as long as the file's size
+// and modification time don't change.
+type cachedChunks struct {
+	name    string // what the excerpts call the file
+	size    int64
+	modTime time.Time
+	chunks  []chunk
+}
+
+// chunkCache holds the chunks of files indexed so far, by absolute
+// path.
+var (
+	chunkCache      = make(map[string]*cachedChunks)
+	chunkCacheMutex sync.Mutex
+)
+
+// retrieveExcerpts returns the chunks of the prompt's Retrieve corpora
+// most relevant to its text, best first.  Corpora are In-style file
+// entries relative to basePath, with a PDF standing for the text
+// extracted to its .pdf.txt, or `@tree` for the responses of the
+// nodes outside the branch from watchPath to path.
+func retrieveExcerpts(store Store, prompt *Prompt, path, watchPath, basePath, rootPath string, ignore *IgnoreList) ([]Excerpt, error) {
+	if len(prompt.Retrieve) == 0 || strings.TrimSpace(prompt.PromptText) == "" {
+		return nil, nil
+	}
+
+	var entries []string
+	var chunks []chunk
+	for _, entry := range prompt.Retrieve {
+		if entry != treeCorpus {
+			entries = append(entries, entry)
+			continue
+		}
+		treeChunks, err := treeChunks(store, path, watchPath, rootPath, ignore)
+		if err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, treeChunks...)
+	}
+
+	files, err := newFileSpec(entries).Expand(store, basePath, rootPath, ignore)
+	if err != nil {
+		return nil, fmt.Errorf("error expanding Retrieve files: %v", err)
+	}
+	seen := make(map[string]bool)
+	for _, name := range files {
+		if strings.EqualFold(filepath.Ext(name), ".pdf") {
+			name += ".txt"
+		}
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		absPath, err := resolvePath(store, rootPath, basePath, name)
+		if err != nil {
+			return nil, fmt.Errorf("error resolving Retrieve file: %v", err)
+		}
+		fileChunks, err := loadChunks(store, absPath, name)
+		if os.IsNotExist(err) && strings.HasSuffix(name, ".pdf.txt") {
+			prompt.Warnings = append(prompt.Warnings, fmt.Sprintf("Retrieve: %s has no extracted text yet", strings.TrimSuffix(name, ".txt")))
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading Retrieve file %s: %v", name, err)
+		}
+		chunks = append(chunks, fileChunks...)
+	}
+
+	top := prompt.RetrieveTop
+	if top == 0 {
+		top = defaultRetrieveTop
+	}
+	return rankChunks(chunks, prompt.PromptText, top), nil
+}
+
+// treeChunks returns the chunks of the nodes below watchPath that
+// aren't on the branch leading to path: their summary if up to date,
+// or else their response.
+func treeChunks(store Store, path, watchPath, rootPath string, ignore *IgnoreList) ([]chunk, error) {
+	branch := make(map[string]bool)
+	for _, p := range nodePaths(path, watchPath) {
+		branch[filepath.Clean(p)] = true
+	}
+
+	ignore = ignore.ForWatchPath(rootPath, watchPath)
+	var chunks []chunk
+	err := walkStore(store, watchPath, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			return nil
+		}
+		if p != watchPath && (strings.HasPrefix(fi.Name(), ".") || ignore.IgnoredPath(rootPath, p, true)) {
+			return filepath.SkipDir
+		}
+		if branch[filepath.Clean(p)] {
+			return nil
+		}
+		kind, content, err := refContent(store, p)
+		if err != nil || content == "" {
+			return err
+		}
+		fn := ResponseFn
+		if kind == "summary" {
+			fn = SummaryFn
+		}
+		rel, err := filepath.Rel(watchPath, filepath.Join(p, fn))
+		if err != nil {
+			return err
+		}
+		chunks = append(chunks, chunkText(filepath.ToSlash(rel), content)...)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error walking %s: %v", watchPath, err)
+	}
+	return chunks, nil
+}
+
+// loadChunks returns the chunks of the file at absPath, called name in
+// excerpts, from the cache if the file hasn't changed.  Binary files
+// have no chunks.
+func loadChunks(store Store, absPath, name string) ([]chunk, error) {
+	fi, err := store.Stat(absPath)
+	if err != nil {
+		return nil, err
+	}
+	chunkCacheMutex.Lock()
+	cached := chunkCache[absPath]
+	chunkCacheMutex.Unlock()
+	if cached != nil && cached.size == fi.Size() && cached.modTime.Equal(fi.ModTime()) && cached.name == name {
+		return cached.chunks, nil
+	}
+	data, err := store.ReadFile(absPath)
+	if err != nil {
+		return nil, err
+	}
+	var chunks []chunk
+	if !bytes.Contains(data, []byte{0}) {
+		chunks = chunkText(name, string(data))
+	}
+	chunkCacheMutex.Lock()
+	chunkCache[absPath] = &cachedChunks{name: name, size: fi.Size(), modTime: fi.ModTime(), chunks: chunks}
+	chunkCacheMutex.Unlock()
+	return chunks, nil
+}
+
+// chunkText splits text into chunks of at most chunkSize characters,
+// breaking at line ends where it can and at spaces where a line is
+// too long.  Form feeds separate pages, as in the .pdf.txt files
+// extracted from PDFs; text without them has no page numbers.
+func chunkText(name, text string) []chunk {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	pages := strings.Split(text, "\f")
+
+	var chunks []chunk
+	line := 1
+	for i, pageText := range pages {
+		page := 0
+		if len(pages) > 1 {
+			page = i + 1
+		}
+		var builder strings.Builder
+		startLine := line
+		flush := func() {
+			content := strings.TrimSpace(builder.String())
+			if content != "" {
+				chunks = append(chunks, newChunk(Excerpt{
+					Filename: name,
+					Page:     page,
+					Line:     startLine,
+					Content:  content,
+				}))
+			}
+			builder.Reset()
+		}
+		for _, l := range strings.SplitAfter(pageText, "\n") {
+			for _, piece := range splitLongLine(l) {
+				if builder.Len() > 0 && builder.Len()+len(piece) > chunkSize {
+					flush()
+					startLine = line
+				}
+				builder.WriteString(piece)
+			}
+			if strings.HasSuffix(l, "\n") {
+				line++
+			}
+		}
+		flush()
+		startLine = line
+	}
+	return chunks
+}
+
+// splitLongLine splits line into pieces of at most chunkSize
+// characters at spaces.
+func splitLongLine(line string) []string {
+	if len(line) <= chunkSize {
+		return []string{line}
+	}
+	var pieces []string
+	for len(line) > chunkSize {
+		i := strings.LastIndex(line[:chunkSize], " ")
+		if i <= 0 {
+			// no space to break at; don't split a character
+			i = chunkSize
+			for i > 0 && !utf8.RuneStart(line[i]) {
+				i--
+			}
+			i--
+		}
+		pieces = append(pieces, line[:i+1])
+		line = line[i+1:]
+	}
+	return append(pieces, line)
+}
+
+// newChunk indexes the excerpt's terms.
+func newChunk(e Excerpt) chunk {
+	c := chunk{Excerpt: e, terms: make(map[string]int)}
+	for _, term := range terms(e.Content) {
+		c.terms[term]++
+		c.length++
+	}
+	return c
+}
+
+// terms splits text into lower case words.
+func terms(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// rankChunks returns the top chunks by BM25 score for query, best
+// first, leaving out chunks sharing no terms with it.
+func rankChunks(chunks []chunk, query string, top int) []Excerpt {
+	if len(chunks) == 0 {
+		return nil
+	}
+	totalLength := 0
+	docFreq := make(map[string]int)
+	for _, c := range chunks {
+		totalLength += c.length
+		for term := range c.terms {
+			docFreq[term]++
+		}
+	}
+	avgLength := float64(totalLength) / float64(len(chunks))
+	n := float64(len(chunks))
+
+	queryTerms := make(map[string]bool)
+	for _, term := range terms(query) {
+		queryTerms[term] = true
+	}
+
+	type scored struct {
+		index int
+		score float64
+	}
+	var results []scored
+	for i, c := range chunks {
+		score := 0.0
+		for term := range queryTerms {
+			tf := float64(c.terms[term])
+			if tf == 0 {
+				continue
+			}
+			df := float64(docFreq[term])
+			idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+			score += idf * tf * (bm25K1 + 1) / (tf + bm25K1*(1-bm25B+bm25B*float64(c.length)/avgLength))
+		}
+		if score > 0 {
+			results = append(results, scored{i, score})
+		}
+	}
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].score > results[j].score
+	})
+	if len(results) > top {
+		results = results[:top]
+	}
+
+	var excerpts []Excerpt
+	for _, r := range results {
+		excerpts = append(excerpts, chunks[r.index].Excerpt)
+	}
+	return excerpts
+}
@@ -0,0 +1,156 @@
+package tree
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestChunkText(t *testing.T) {
+	// Pages are separated by form feeds; a long page without newlines
+	// is split at spaces
+	long := strings.Repeat("word ", chunkSize/5*2)
+	text := "first page\nsecond line\n\f" + long + "\fthird page"
+	chunks := chunkText("doc.pdf.txt", text)
+
+	if len(chunks) != 4 {
+		t.Fatalf("Expected 4 chunks, got %d", len(chunks))
+	}
+	expected := []struct {
+		page int
+		line int
+	}{{1, 1}, {2, 3}, {2, 3}, {3, 3}}
+	for i, c := range chunks {
+		if c.Page != expected[i].page || c.Line != expected[i].line {
+			t.Errorf("Chunk %d: expected page %d line %d, got page %d line %d", i, expected[i].page, expected[i].line, c.Page, c.Line)
+		}
+		if len(c.Content) > chunkSize {
+			t.Errorf("Chunk %d: %d bytes is more than %d", i, len(c.Content), chunkSize)
+		}
+	}
+	if chunks[0].Content != "first page\nsecond line" {
+		t.Errorf("Unexpected first chunk %q", chunks[0].Content)
+	}
+
+	// Text without form feeds has no pages, just lines
+	var lines []string
+	for i := 0; i < 100; i++ {
+		lines = append(lines, fmt.Sprintf("line %d %s", i+1, strings.Repeat("x", 40)))
+	}
+	chunks = chunkText("notes.txt", strings.Join(lines, "\n"))
+	if len(chunks) < 2 {
+		t.Fatalf("Expected several chunks, got %d", len(chunks))
+	}
+	for _, c := range chunks {
+		if c.Page != 0 {
+			t.Errorf("Expected no page, got %d", c.Page)
+		}
+		if !strings.HasPrefix(c.Content, fmt.Sprintf("line %d ", c.Line)) {
+			t.Errorf("Chunk starting at line %d starts with %q", c.Line, c.Content[:10])
+		}
+	}
+}
+
+func TestRankChunks(t *testing.T) {
+	chunks := []chunk{
+		newChunk(Excerpt{Filename: "a.txt", Content: "The cat sat on the mat."}),
+		newChunk(Excerpt{Filename: "b.txt", Content: "Turbines need regular maintenance of the gearbox."}),
+		newChunk(Excerpt{Filename: "c.txt", Content: "The gearbox failed; gearbox maintenance was late."}),
+		newChunk(Excerpt{Filename: "d.txt", Content: "Nothing relevant here."}),
+	}
+	excerpts := rankChunks(chunks, "Why did the gearbox fail?", 2)
+	if len(excerpts) != 2 {
+		t.Fatalf("Expected 2 excerpts, got %d", len(excerpts))
+	}
+	if excerpts[0].Filename != "c.txt" || excerpts[1].Filename != "b.txt" {
+		t.Errorf("Expected c.txt then b.txt, got %s then %s", excerpts[0].Filename, excerpts[1].Filename)
+	}
+
+	if excerpts := rankChunks(chunks, "unrelated query", 2); len(excerpts) != 0 {
+		t.Errorf("Expected no excerpts, got %+v", excerpts)
+	}
+}
+
+func TestRetrieveHeader(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "test_retrieve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootDir)
+	watchDir := filepath.Join(rootDir, ".aidss")
+
+	// A long "PDF" whose extracted text has the answer on page 42
+	var pages []string
+	for i := 1; i <= 60; i++ {
+		pages = append(pages, fmt.Sprintf("Page %d discusses routine matters at length.", i))
+	}
+	pages[41] = "The warranty expires after seven years of service."
+	mkFiles(t, rootDir, "docs/manual.pdf", "docs/other.pdf")
+	err = ioutil.WriteFile(filepath.Join(rootDir, "docs", "manual.pdf.txt"), []byte(strings.Join(pages, "\f")), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A sibling branch whose response also mentions the warranty
+	sibling := filepath.Join(watchDir, "sibling")
+	err = os.MkdirAll(sibling, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(sibling, ResponseFn), []byte("We decided the warranty is worth extending."), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &recordingClient{}
+	node := filepath.Join(watchDir, "question")
+	err = os.MkdirAll(node, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prompt := "Retrieve: docs/*.pdf @tree\nRetrieve-Top: 2\n\nWhen does the warranty expire?"
+	err = ioutil.WriteFile(filepath.Join(node, PromptFn), []byte(prompt), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handleUserMessage(context.Background(), OS, node, client, watchDir, rootDir)
+
+	messages := client.lastCall()
+	if len(messages) == 0 {
+		t.Fatal("Expected the prompt to be sent")
+	}
+	content := messages[len(messages)-1].Content
+	for _, s := range []string{
+		`<EXCERPT filename="docs/manual.pdf.txt" page="42"`,
+		"seven years",
+		`<EXCERPT filename="sibling/response.txt"`,
+	} {
+		if !strings.Contains(content, s) {
+			t.Errorf("Expected the prompt to contain %q, got:\n%s", s, content)
+		}
+	}
+	if strings.Contains(content, "routine matters") {
+		t.Errorf("Expected only the top 2 excerpts, got:\n%s", content)
+	}
+
+	// The excerpts are kept as parts of the transcript
+	transcript, err := loadTranscript(OS, node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, msg := range transcript {
+		for _, part := range msg.Parts {
+			if part.Type == "excerpt" && part.Page == 42 {
+				found = true
+			}
+		}
+	}
+	if !found {
+		t.Errorf("Expected an excerpt part for page 42 in the transcript")
+	}
+}
@@ -0,0 +1,151 @@
+package tree
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Store is where the decision tree and the project files it refers to
+// are kept.  Names are slash- or OS-separated paths as used with the
+// os package; errors for missing files satisfy os.IsNotExist.
+type Store interface {
+	// ReadFile returns the content of the named file.
+	ReadFile(name string) ([]byte, error)
+	// WriteFile replaces the named file's content, creating it if
+	// need be.  Readers may see a partial file while it is written.
+	WriteFile(name string, data []byte) error
+	// WriteFileAtomic replaces the named file's content so that
+	// readers see either the old content or the new, never a mix.
+	WriteFileAtomic(name string, data []byte) error
+	// Remove removes the named file or empty directory.
+	Remove(name string) error
+	// Stat describes the named file, following symbolic links.
+	Stat(name string) (os.FileInfo, error)
+	// Lstat describes the named file, or the link if it is one.
+	Lstat(name string) (os.FileInfo, error)
+	// ReadDir lists the entries of the named directory, sorted by
+	// name, as Lstat describes them.
+	ReadDir(name string) ([]os.FileInfo, error)
+	// MkdirAll creates the named directory and any missing parents.
+	MkdirAll(name string) error
+	// EvalSymlinks returns the name after resolving any symbolic
+	// links; the named file must exist.
+	EvalSymlinks(name string) (string, error)
+	// Watch returns a watcher for changes to the store's directories.
+	Watch() (Watcher, error)
+}
+
+// osStore is a Store on the operating system's filesystem.
+type osStore struct {
+	watchBackend string        // watcher backend, or "" for auto
+	pollInterval time.Duration // how often a polling watcher scans
+}
+
+// OS is the operating system's filesystem, watched with the default
+// watcher.
+var OS Store = &osStore{}
+
+// NewOSStore returns the operating system's filesystem, watched with
+// watchBackend ("" for auto), polling every pollInterval if it polls.
+func NewOSStore(watchBackend string, pollInterval time.Duration) Store {
+	return &osStore{watchBackend: watchBackend, pollInterval: pollInterval}
+}
+
+// ReadFile returns the content of the named file.
+func (s *osStore) ReadFile(name string) ([]byte, error) {
+	return ioutil.ReadFile(name)
+}
+
+// WriteFile replaces the named file's content.
+func (s *osStore) WriteFile(name string, data []byte) error {
+	return ioutil.WriteFile(name, data, 0644)
+}
+
+// WriteFileAtomic replaces the named file's content by renaming a
+// temporary file into place.
+func (s *osStore) WriteFileAtomic(name string, data []byte) error {
+	return WriteFileAtomic(name, data)
+}
+
+// Remove removes the named file or empty directory.
+func (s *osStore) Remove(name string) error {
+	return os.Remove(name)
+}
+
+// Stat describes the named file.
+func (s *osStore) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+// Lstat describes the named file without following a link.
+func (s *osStore) Lstat(name string) (os.FileInfo, error) {
+	return os.Lstat(name)
+}
+
+// ReadDir lists the entries of the named directory.
+func (s *osStore) ReadDir(name string) ([]os.FileInfo, error) {
+	return ioutil.ReadDir(name)
+}
+
+// MkdirAll creates the named directory and any missing parents.
+func (s *osStore) MkdirAll(name string) error {
+	return os.MkdirAll(name, 0755)
+}
+
+// EvalSymlinks resolves any symbolic links in the name.
+func (s *osStore) EvalSymlinks(name string) (string, error) {
+	return filepath.EvalSymlinks(name)
+}
+
+// Watch returns a watcher using the store's backend.
+func (s *osStore) Watch() (Watcher, error) {
+	backend := s.watchBackend
+	if backend == "" {
+		backend = WatchAuto
+	}
+	return NewWatcher(backend, s.pollInterval)
+}
+
+// walkStore walks the tree rooted at root in store as filepath.Walk
+// does the filesystem: in lexical order, calling fn for every file and
+// directory, and skipping a directory's contents if fn returns
+// filepath.SkipDir for it.  Symbolic links aren't followed.
+func walkStore(store Store, root string, fn filepath.WalkFunc) error {
+	fi, err := store.Lstat(root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		err = walkStoreDir(store, root, fi, fn)
+	}
+	if err == filepath.SkipDir {
+		return nil
+	}
+	return err
+}
+
+// walkStoreDir calls fn for path and, if it is a directory, the
+// entries below it.
+func walkStoreDir(store Store, path string, fi os.FileInfo, fn filepath.WalkFunc) error {
+	if !fi.IsDir() {
+		return fn(path, fi, nil)
+	}
+	entries, err := store.ReadDir(path)
+	err1 := fn(path, fi, err)
+	if err != nil || err1 != nil {
+		// as filepath.Walk: a read error is fn's to handle
+		return err1
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	for _, entry := range entries {
+		err = walkStoreDir(store, filepath.Join(path, entry.Name()), entry, fn)
+		if err != nil {
+			if !entry.IsDir() || err != filepath.SkipDir {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+package tree
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+
+	"github.com/stevegt/aidss/llm"
+)
+
+func TestMemStore(t *testing.T) {
+	store := NewMemStore()
+
+	// Files need their directory
+	if err := store.WriteFile("/a/b.txt", []byte("b")); !os.IsNotExist(err) {
+		t.Errorf("Expected a missing directory error, got %v", err)
+	}
+	if err := store.MkdirAll("/a/c"); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"/a/b.txt", "/a/c/d.txt"} {
+		if err := store.WriteFileAtomic(name, []byte(filepath.Base(name))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := store.ReadFile("/a/b.txt")
+	if err != nil || string(data) != "b.txt" {
+		t.Errorf("Expected b.txt, got %q, %v", data, err)
+	}
+	if _, err := store.ReadFile("/a/missing.txt"); !os.IsNotExist(err) {
+		t.Errorf("Expected a missing file error, got %v", err)
+	}
+	fi, err := store.Stat("/a/c")
+	if err != nil || !fi.IsDir() {
+		t.Errorf("Expected /a/c to be a directory, got %v, %v", fi, err)
+	}
+
+	// Later writes have later modification times
+	before, _ := store.Stat("/a/b.txt")
+	if err := store.WriteFile("/a/b.txt", []byte("bb")); err != nil {
+		t.Fatal(err)
+	}
+	after, _ := store.Stat("/a/b.txt")
+	if !after.ModTime().After(before.ModTime()) || after.Size() != 2 {
+		t.Errorf("Expected a newer, longer file, got %v then %v", before.ModTime(), after.ModTime())
+	}
+
+	entries, err := store.ReadDir("/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if strings.Join(names, " ") != "b.txt c" {
+		t.Errorf("Expected [b.txt c], got %v", names)
+	}
+
+	var walked []string
+	err = walkStore(store, "/a", func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		walked = append(walked, p)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(walked, " ") != "/a /a/b.txt /a/c /a/c/d.txt" {
+		t.Errorf("Expected the tree in lexical order, got %v", walked)
+	}
+
+	if err := store.Remove("/a/c"); err == nil {
+		t.Errorf("Expected removing a non-empty directory to fail")
+	}
+	if err := store.Remove("/a/c/d.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Remove("/a/c"); err != nil {
+		t.Errorf("Expected to remove an empty directory, got %v", err)
+	}
+}
+
+func TestMemStoreWatch(t *testing.T) {
+	store := NewMemStore()
+	if err := store.MkdirAll("/tree/node"); err != nil {
+		t.Fatal(err)
+	}
+	w, err := store.Watch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if err := w.Add("/tree"); err != nil {
+		t.Fatal(err)
+	}
+
+	expect := func(op fsnotify.Op, name string) {
+		t.Helper()
+		select {
+		case event := <-w.Events():
+			if event.Op != op || event.Name != name {
+				t.Errorf("Expected %v %s, got %v", op, name, event)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("Expected %v %s, got nothing", op, name)
+		}
+	}
+
+	// Changes in unwatched directories aren't reported
+	store.WriteFile("/tree/node/prompt.txt", []byte("Hello"))
+	store.WriteFile("/tree/prompt.txt", []byte("Hello"))
+	expect(fsnotify.Create, "/tree/prompt.txt")
+	store.WriteFile("/tree/prompt.txt", []byte("Hello again"))
+	expect(fsnotify.Write, "/tree/prompt.txt")
+	store.MkdirAll("/tree/new/child")
+	expect(fsnotify.Create, "/tree/new")
+	store.Remove("/tree/prompt.txt")
+	expect(fsnotify.Remove, "/tree/prompt.txt")
+}
+
+func TestHandleUserMessageMemStore(t *testing.T) {
+	store := NewMemStore()
+	rootDir := "/project"
+	watchDir := filepath.Join(rootDir, ".aidss")
+	write := func(name, content string) {
+		if err := store.MkdirAll(filepath.Dir(name)); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.WriteFile(name, []byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(filepath.Join(rootDir, "notes.md"), "Some notes")
+	write(filepath.Join(watchDir, PromptFn), "In: notes.md\nOut: out.txt\n\nSummarize my notes")
+
+	// A whole turn, from prompt to Out file, runs in memory
+	client := &outClient{response: "<OUT filename=\"out.txt\">\nSummary\n</OUT>"}
+	err := handleUserMessage(context.Background(), store, watchDir, client, watchDir, rootDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(client.last, "Some notes") {
+		t.Errorf("Expected the In file in the request, got %q", client.last)
+	}
+	for _, name := range []string{
+		filepath.Join(watchDir, ResponseFn),
+		filepath.Join(watchDir, MessagesFn),
+		filepath.Join(watchDir, PromptFullFn),
+	} {
+		if _, err := store.Stat(name); err != nil {
+			t.Errorf("Expected %s in the store, got %v", name, err)
+		}
+	}
+	data, err := store.ReadFile(filepath.Join(rootDir, "out.txt"))
+	if err != nil || strings.TrimSpace(string(data)) != "Summary" {
+		t.Errorf("Expected the Out file in the store, got %q, %v", data, err)
+	}
+	if _, err := os.Stat(rootDir); !os.IsNotExist(err) {
+		t.Errorf("Expected nothing written to the filesystem, got %v", err)
+	}
+
+	// A child node sees its parent's turn
+	child, err := createNewDecisionNode(store, watchDir, "next step")
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := buildContextMessages(store, child, watchDir)
+	if len(messages) != 2 || !strings.Contains(messages[1].Content, "Summary") {
+		t.Errorf("Expected the parent's turn, got %v", messages)
+	}
+}
+
+// outClient is an llm.Client that returns a fixed response and keeps
+// the content of the last message it was sent.
+type outClient struct {
+	recordingClient
+	response string
+	last     string
+}
+
+func (c *outClient) GenerateResponse(ctx context.Context, messages []llm.Message) (string, error) {
+	c.last = messages[len(messages)-1].Content
+	return c.response, nil
+}
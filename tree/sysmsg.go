@@ -0,0 +1,81 @@
+package tree
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/stevegt/aidss/llm"
+)
+
+// effectiveSysMsg returns the system prompt for the node at path.
+//
+// A node inherits the system prompt recorded in the messages.json of
+// its nearest answered ancestor, or, if there is none, the project's
+// default system prompt in the watch path's sysmsg.txt.  A Sysmsg
+// header in the node's prompt.txt, its own directory's defaults.txt or
+// its template replaces the inherited prompt; Sysmsg+ headers add to
+// it.  Sysmsg headers from ancestors' defaults.txt files are already
+// part of what the ancestor recorded, so they are only applied when no
+// ancestor has been answered.
+func effectiveSysMsg(store Store, prompt *Prompt, path, watchPath string) (string, error) {
+	inherited, found, err := inheritedSysMsg(store, path, watchPath)
+	if err != nil {
+		return "", err
+	}
+	if !found {
+		data, err := store.ReadFile(filepath.Join(watchPath, SysmsgFn))
+		if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+		inherited = strings.TrimSpace(string(data))
+	}
+
+	sysMsg := inherited
+	replaced := false
+	for _, h := range prompt.Headers {
+		if strings.TrimSuffix(h.Name, "+") != "sysmsg" {
+			continue
+		}
+		if found && isAncestorDefaults(h.File) {
+			continue
+		}
+		if h.Name == "sysmsg" && !replaced {
+			sysMsg = ""
+			replaced = true
+		}
+		if sysMsg != "" {
+			sysMsg += "\n"
+		}
+		sysMsg += h.Value
+	}
+	return sysMsg, nil
+}
+
+// isAncestorDefaults reports whether the header file name, relative
+// to the node, is a defaults file in an ancestor directory.
+func isAncestorDefaults(file string) bool {
+	return filepath.Base(file) == DefaultsFn && strings.HasPrefix(file, "..")
+}
+
+// inheritedSysMsg returns the system prompt recorded by the nearest
+// ancestor of path that has a messages.json, and whether there is one.
+func inheritedSysMsg(store Store, path, watchPath string) (string, bool, error) {
+	paths := nodePaths(path, watchPath)
+	for i := len(paths) - 2; i >= 0; i-- {
+		transcript, err := loadTranscript(store, paths[i])
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", false, err
+		}
+		for _, msg := range transcript {
+			if msg.Role == llm.ChatMessageRoleSystem {
+				return msg.Content, true, nil
+			}
+		}
+		return "", true, nil
+	}
+	return "", false, nil
+}
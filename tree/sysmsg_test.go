@@ -0,0 +1,99 @@
+package tree
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stevegt/aidss/llm"
+)
+
+// recordingClient is an llm.Client that records the messages it is
+// sent.
+type recordingClient struct {
+	calls [][]llm.Message
+	model llm.Model // zero for a model with an unknown context window
+}
+
+func (c *recordingClient) GenerateResponse(ctx context.Context, messages []llm.Message) (string, error) {
+	c.calls = append(c.calls, messages)
+	return "Recorded response.", nil
+}
+
+func (c *recordingClient) Model() llm.Model {
+	if c.model.Name == "" {
+		return llm.Model{Name: "recording-model", MaxTokens: 1000}
+	}
+	return c.model
+}
+
+// lastCall returns the messages of the most recent call.
+func (c *recordingClient) lastCall() []llm.Message {
+	if len(c.calls) == 0 {
+		return nil
+	}
+	return c.calls[len(c.calls)-1]
+}
+
+func TestSystemMessageInheritance(t *testing.T) {
+	watchDir, err := ioutil.TempDir("", "test_sysmsg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(watchDir)
+
+	client := &recordingClient{}
+	ask := func(dir, prompt string) []llm.Message {
+		err := os.MkdirAll(dir, 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(filepath.Join(dir, PromptFn), []byte(prompt), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		handleUserMessage(context.Background(), OS, dir, client, watchDir, watchDir)
+		return client.lastCall()
+	}
+	expectSystem := func(messages []llm.Message, expected string) {
+		t.Helper()
+		if len(messages) == 0 || messages[0].Role != llm.ChatMessageRoleSystem {
+			t.Fatalf("Expected a system message first, got %+v", messages)
+		}
+		if messages[0].Content != expected {
+			t.Errorf("Expected system message %q, got %q", expected, messages[0].Content)
+		}
+		for _, msg := range messages[1:] {
+			if msg.Role == llm.ChatMessageRoleSystem {
+				t.Errorf("Expected a single system message, got another: %q", msg.Content)
+			}
+		}
+	}
+
+	// The project default applies when nothing up the branch sets one
+	err = ioutil.WriteFile(filepath.Join(watchDir, SysmsgFn), []byte("Project default.\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectSystem(ask(watchDir, "Root question"), "Project default.")
+
+	// A node's Sysmsg replaces what it inherits
+	parentDir := filepath.Join(watchDir, "parent")
+	expectSystem(ask(parentDir, "Sysmsg: Be an analyst.\n\nParent question"), "Be an analyst.")
+
+	// Children inherit it, and may extend it
+	childDir := filepath.Join(parentDir, "child")
+	messages := ask(childDir, "Child question")
+	expectSystem(messages, "Be an analyst.")
+	if len(messages) != 6 {
+		t.Errorf("Expected system message plus 5 history and user messages, got %d", len(messages))
+	}
+	grandchildDir := filepath.Join(childDir, "grandchild")
+	expectSystem(ask(grandchildDir, "Sysmsg+: Use tables.\n\nGrandchild question"), "Be an analyst.\nUse tables.")
+
+	// A sibling branch replaces it
+	siblingDir := filepath.Join(parentDir, "sibling")
+	expectSystem(ask(siblingDir, "Sysmsg: Be a critic.\n\nSibling question"), "Be a critic.")
+}
@@ -0,0 +1,180 @@
+package tree
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// templateRE matches `{{name}}` placeholders and `{{include "file"}}`
+// directives.  Anything else in double braces is left alone.
+var templateRE = regexp.MustCompile(`\{\{\s*(?:include\s+"([^"]*)"|([A-Za-z][A-Za-z0-9_-]*))\s*\}\}`)
+
+// promptVar is the template variable holding the node's own prompt
+// text.
+const promptVar = "prompt"
+
+// maxIncludeDepth limits nested includes, so that a file including
+// itself is an error rather than a hang.
+const maxIncludeDepth = 10
+
+// promptTemplate is a template from the template library.  It is
+// formatted like a prompt file: optional headers, then the text.
+type promptTemplate struct {
+	file     string // path relative to the node, for messages
+	headers  []Header
+	text     string
+	textLine int // line of the file the text starts on
+}
+
+// loadTemplate loads the named template from the template library in
+// watchPath.  The name may leave off the .txt extension.
+func loadTemplate(store Store, path, watchPath, name string) (*promptTemplate, error) {
+	libDir := filepath.Join(watchPath, TemplatesDir)
+	templatePath := filepath.Join(libDir, filepath.FromSlash(name))
+	if !IsWithin(filepath.Clean(libDir), filepath.Clean(templatePath)) {
+		return nil, fmt.Errorf("template %s: outside template library %s", name, libDir)
+	}
+	data, err := store.ReadFile(templatePath)
+	if os.IsNotExist(err) && filepath.Ext(templatePath) == "" {
+		templatePath += ".txt"
+		data, err = store.ReadFile(templatePath)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("template %s: %v", name, err)
+	}
+
+	file, err := filepath.Rel(path, templatePath)
+	if err != nil {
+		return nil, err
+	}
+	content := strings.ReplaceAll(string(data), "\r\n", "\n")
+	headers, text, err := parseHeaderBlock(file, content)
+	if err != nil {
+		return nil, err
+	}
+	return &promptTemplate{
+		file:     file,
+		headers:  headers,
+		text:     text,
+		textLine: strings.Count(content, "\n") - strings.Count(text, "\n") + 1,
+	}, nil
+}
+
+// expandTemplate renders the prompt text, which starts at bodyLine of
+// prompt.txt: `{{name}}` is replaced by the template variable name,
+// and `{{include "file"}}` by the rendered content of file in the
+// template library.  Variables come from the Vars file and Var-name
+// headers, the latter taking precedence; names are case-insensitive.
+//
+// Prompts that use no template, Vars file or Var-name header are left
+// alone, so that plain prompts may contain double braces.  If tmpl is
+// not nil, the rendered template text becomes the prompt text, with
+// the node's own rendered text in place of `{{prompt}}`, or after the
+// template text if the template has no `{{prompt}}`.
+func (p *Prompt) expandTemplate(store Store, path, watchPath, rootPath string, bodyLine int, tmpl *promptTemplate) error {
+	if tmpl == nil && p.VarsFile == "" && len(p.Vars) == 0 {
+		return nil
+	}
+
+	vars := make(map[string]string)
+	if p.VarsFile != "" {
+		varsPath, err := resolvePath(store, rootPath, path, p.VarsFile)
+		if err != nil {
+			return fmt.Errorf("error resolving Vars file: %v", err)
+		}
+		data, err := store.ReadFile(varsPath)
+		if err != nil {
+			return fmt.Errorf("error reading Vars file: %v", err)
+		}
+		content := strings.ReplaceAll(string(data), "\r\n", "\n")
+		headers, _, err := parseHeaders(p.VarsFile, strings.Split(content, "\n"))
+		if err != nil {
+			return err
+		}
+		for _, h := range headers {
+			vars[h.Name] = h.Value
+		}
+	}
+	for name, value := range p.Vars {
+		vars[name] = value
+	}
+
+	libDir := filepath.Join(watchPath, TemplatesDir)
+	text, err := renderTemplate(store, PromptFn, bodyLine, p.PromptText, vars, libDir, 0)
+	if err != nil {
+		return err
+	}
+	if tmpl == nil {
+		p.PromptText = text
+		return nil
+	}
+
+	vars[promptVar] = text
+	rendered, err := renderTemplate(store, tmpl.file, tmpl.textLine, tmpl.text, vars, libDir, 0)
+	if err != nil {
+		return err
+	}
+	if !usesVar(tmpl.text, promptVar) && strings.TrimSpace(text) != "" {
+		rendered = strings.TrimRight(rendered, "\n") + "\n\n" + text
+	}
+	p.PromptText = rendered
+	return nil
+}
+
+// renderTemplate renders text, which starts at line firstLine of
+// file, replacing placeholders with vars and include directives with
+// the rendered content of files in libDir.
+func renderTemplate(store Store, file string, firstLine int, text string, vars map[string]string, libDir string, depth int) (string, error) {
+	var builder strings.Builder
+	last := 0
+	for _, loc := range templateRE.FindAllStringSubmatchIndex(text, -1) {
+		builder.WriteString(text[last:loc[0]])
+		last = loc[1]
+		line := firstLine + strings.Count(text[:loc[0]], "\n")
+
+		if loc[2] >= 0 {
+			// {{include "file"}}
+			name := text[loc[2]:loc[3]]
+			if depth >= maxIncludeDepth {
+				return "", &ParseError{file, line, fmt.Sprintf("includes nested more than %d deep", maxIncludeDepth)}
+			}
+			includePath := filepath.Join(libDir, filepath.FromSlash(name))
+			if !IsWithin(filepath.Clean(libDir), filepath.Clean(includePath)) {
+				return "", &ParseError{file, line, fmt.Sprintf("include %q: outside template library", name)}
+			}
+			data, err := store.ReadFile(includePath)
+			if err != nil {
+				return "", &ParseError{file, line, fmt.Sprintf("include %q: %v", name, err)}
+			}
+			included, err := renderTemplate(store, name, 1, string(data), vars, libDir, depth+1)
+			if err != nil {
+				return "", err
+			}
+			builder.WriteString(included)
+			continue
+		}
+
+		// {{name}}
+		name := strings.ToLower(text[loc[4]:loc[5]])
+		value, ok := vars[name]
+		if !ok {
+			return "", &ParseError{file, line, fmt.Sprintf("undefined template variable %q", name)}
+		}
+		builder.WriteString(value)
+	}
+	builder.WriteString(text[last:])
+	return builder.String(), nil
+}
+
+// usesVar reports whether text has a placeholder for the variable name.
+func usesVar(text, name string) bool {
+	for _, m := range templateRE.FindAllStringSubmatch(text, -1) {
+		if strings.ToLower(m[2]) == name {
+			return true
+		}
+	}
+	return false
+}
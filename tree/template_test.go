@@ -0,0 +1,139 @@
+package tree
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadPromptTemplate(t *testing.T) {
+	watchDir, err := ioutil.TempDir("", "test_template")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(watchDir)
+
+	nodeDir := filepath.Join(watchDir, "option_a")
+	files := map[string]string{
+		filepath.Join(watchDir, TemplatesDir, "evaluate.txt"): `In: criteria.md
+Sysmsg: You are a decision analyst.
+
+Evaluate the option "{{option}}" against each criterion.
+{{include "scoring.txt"}}
+{{prompt}}
+`,
+		filepath.Join(watchDir, TemplatesDir, "scoring.txt"): "Score each criterion from 1 to {{max}}.",
+		filepath.Join(nodeDir, "vars.txt"):                   "Option: Rewrite in Rust\nMax: 5\n",
+		filepath.Join(nodeDir, PromptFn): `Template: evaluate
+Vars: vars.txt
+Var-max: 10
+In+: option_a.md
+
+Pay attention to {{Option}}'s hiring cost.`,
+	}
+	for fn, content := range files {
+		err = os.MkdirAll(filepath.Dir(fn), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(fn, []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	prompt, err := loadPrompt(OS, nodeDir, watchDir, watchDir)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	expectedText := `Evaluate the option "Rewrite in Rust" against each criterion.
+Score each criterion from 1 to 10.
+Pay attention to Rewrite in Rust's hiring cost.
+`
+	if prompt.PromptText != expectedText {
+		t.Errorf("Expected PromptText %q, got %q", expectedText, prompt.PromptText)
+	}
+	if !equalStringSlices(prompt.InFiles, []string{"criteria.md", "option_a.md"}) {
+		t.Errorf("Expected InFiles [criteria.md option_a.md], got %v", prompt.InFiles)
+	}
+	if prompt.SysMsg != "You are a decision analyst." {
+		t.Errorf("Expected SysMsg from template, got %q", prompt.SysMsg)
+	}
+
+	// An undefined variable is reported where it is used
+	err = ioutil.WriteFile(filepath.Join(nodeDir, PromptFn), []byte("Var-x: 1\n\nFirst line\n{{y}}"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = loadPrompt(OS, nodeDir, watchDir, watchDir)
+	expectedErr := `prompt.txt:4: undefined template variable "y"`
+	if err == nil || err.Error() != expectedErr {
+		t.Errorf("Expected error %q, got %v", expectedErr, err)
+	}
+
+	// Prompts that don't use templates are left alone
+	err = ioutil.WriteFile(filepath.Join(nodeDir, PromptFn), []byte("What does {{.Name}} or {{y}} do?"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prompt, err = loadPrompt(OS, nodeDir, watchDir, watchDir)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if prompt.PromptText != "What does {{.Name}} or {{y}} do?" {
+		t.Errorf("Expected PromptText unchanged, got %q", prompt.PromptText)
+	}
+}
+
+func TestVarsFileConfined(t *testing.T) {
+	store := NewMemStore()
+	rootDir := "/project"
+	watchDir := filepath.Join(rootDir, ".aidss")
+	nodeDir := filepath.Join(watchDir, "node")
+	for _, dir := range []string{"/etc", nodeDir} {
+		if err := store.MkdirAll(dir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.WriteFile("/etc/secret", []byte("Password: hunter2\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.WriteFile(filepath.Join(rootDir, "vars.txt"), []byte("Option: A\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		vars     string
+		expected string // prompt text, or "" for an error
+	}{
+		{"../../vars.txt", "Option A"},
+		{"/project/vars.txt", "Option A"},
+		{"../../../etc/secret", ""},
+		{"/etc/secret", ""},
+	}
+	for _, c := range cases {
+		content := "Vars: " + c.vars + "\n\nOption {{option}}{{password}}"
+		if c.expected != "" {
+			content = "Vars: " + c.vars + "\n\nOption {{option}}"
+		}
+		if err := store.WriteFile(filepath.Join(nodeDir, PromptFn), []byte(content)); err != nil {
+			t.Fatal(err)
+		}
+		prompt, err := loadPrompt(store, nodeDir, watchDir, rootDir)
+		if c.expected == "" {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %q", c.vars, prompt.PromptText)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: expected no error, got %v", c.vars, err)
+			continue
+		}
+		if prompt.PromptText != c.expected {
+			t.Errorf("%s: expected %q, got %q", c.vars, c.expected, prompt.PromptText)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package tree
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/stevegt/aidss/llm"
+)
+
+// TranscriptMessage is one message of a node's transcript, as stored
+// in messages.json.  Unlike the `Role: content` lines of
+// prompt-full.txt it can be read back without loss, by us or by other
+// tools.
+type TranscriptMessage struct {
+	Role       string         `json:"role"`
+	Content    string         `json:"content"`
+	Parts      []ContentPart  `json:"parts,omitempty"`
+	Name       string         `json:"name,omitempty"`
+	ToolCalls  []llm.ToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string         `json:"tool_call_id,omitempty"`
+	Timestamp  time.Time      `json:"timestamp"`
+	Model      string         `json:"model,omitempty"`
+}
+
+// ContentPart is one part of a multi-part message.  Content holds the
+// parts flattened into the text sent to the LLM.
+type ContentPart struct {
+	Type     string `json:"type"` // "text", "file" or "excerpt"
+	Text     string `json:"text"`
+	Filename string `json:"filename,omitempty"`
+	Page     int    `json:"page,omitempty"`
+	Line     int    `json:"line,omitempty"`
+}
+
+// Message returns the message as sent to the LLM.
+func (m TranscriptMessage) Message() llm.Message {
+	return llm.Message{
+		Role:       m.Role,
+		Content:    m.Content,
+		Name:       m.Name,
+		ToolCalls:  m.ToolCalls,
+		ToolCallID: m.ToolCallID,
+	}
+}
+
+// userTranscriptMessage returns the transcript message for a user
+// turn, with the prompt text, each attachment and each excerpt as
+// separate parts.
+func userTranscriptMessage(turn *Turn, now time.Time) TranscriptMessage {
+	parts := []ContentPart{{Type: "text", Text: turn.Prompt}}
+	for _, a := range turn.Attachments {
+		parts = append(parts, ContentPart{Type: "file", Text: a.Content, Filename: a.Filename})
+	}
+	for _, e := range turn.Excerpts {
+		parts = append(parts, ContentPart{Type: "excerpt", Text: e.Content, Filename: e.Filename, Page: e.Page, Line: e.Line})
+	}
+	return TranscriptMessage{
+		Role:      llm.ChatMessageRoleUser,
+		Content:   turn.Content(),
+		Parts:     parts,
+		Timestamp: now,
+	}
+}
+
+// saveTranscript saves the node's messages to messages.json.
+func saveTranscript(store Store, path string, messages []TranscriptMessage) error {
+	data, err := json.MarshalIndent(messages, "", "  ")
+	if err != nil {
+		return err
+	}
+	return store.WriteFileAtomic(filepath.Join(path, MessagesFn), data)
+}
+
+// loadTranscript loads the node's messages from messages.json.  If
+// the user has since edited response.txt, the edited text replaces
+// the content of the final assistant message.
+func loadTranscript(store Store, path string) ([]TranscriptMessage, error) {
+	data, err := store.ReadFile(filepath.Join(path, MessagesFn))
+	if err != nil {
+		return nil, err
+	}
+	var messages []TranscriptMessage
+	err = json.Unmarshal(data, &messages)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s: %v", filepath.Join(path, MessagesFn), err)
+	}
+
+	last := len(messages) - 1
+	if last >= 0 && messages[last].Role == llm.ChatMessageRoleAssistant {
+		response, err := store.ReadFile(filepath.Join(path, ResponseFn))
+		if err == nil && string(response) != messages[last].Content {
+			messages[last].Content = string(response)
+		} else if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return messages, nil
+}
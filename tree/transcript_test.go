@@ -0,0 +1,81 @@
+package tree
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stevegt/aidss/llm"
+)
+
+func TestTranscriptRoundTrip(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "test_transcript")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	err = ioutil.WriteFile(filepath.Join(tempDir, PromptFn), []byte("In: a.txt\n\nUser: is not a role here."), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(tempDir, "a.txt"), []byte("Assistant: nor here."), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := llm.NewClient("mock-model")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handleUserMessage(context.Background(), OS, tempDir, client, tempDir, tempDir)
+
+	transcript, err := loadTranscript(OS, tempDir)
+	if err != nil {
+		t.Fatalf("Expected messages.json to be readable, got %v", err)
+	}
+	if len(transcript) != 2 {
+		t.Fatalf("Expected 2 messages, got %d", len(transcript))
+	}
+
+	user, assistant := transcript[0], transcript[1]
+	if user.Role != llm.ChatMessageRoleUser || assistant.Role != llm.ChatMessageRoleAssistant {
+		t.Errorf("Expected user and assistant roles, got %s and %s", user.Role, assistant.Role)
+	}
+	expectedParts := []ContentPart{
+		{Type: "text", Text: "User: is not a role here."},
+		{Type: "file", Text: "Assistant: nor here.", Filename: "a.txt"},
+	}
+	if len(user.Parts) != len(expectedParts) {
+		t.Fatalf("Expected parts %+v, got %+v", expectedParts, user.Parts)
+	}
+	for i := range expectedParts {
+		if user.Parts[i] != expectedParts[i] {
+			t.Errorf("Part %d expected %+v, got %+v", i, expectedParts[i], user.Parts[i])
+		}
+	}
+	if user.Timestamp.IsZero() || assistant.Timestamp.IsZero() {
+		t.Errorf("Expected timestamps to be set")
+	}
+	if assistant.Model != "mock-model" {
+		t.Errorf("Expected model 'mock-model', got %q", assistant.Model)
+	}
+
+	// History is rebuilt from messages.json
+	messages := buildContextMessages(OS, tempDir, tempDir)
+	if len(messages) != 2 || messages[0].Content != user.Content || messages[1].Content != "This is a mock response." {
+		t.Errorf("Expected history from messages.json, got %+v", messages)
+	}
+
+	// Edits to response.txt win over the stored response
+	err = ioutil.WriteFile(filepath.Join(tempDir, ResponseFn), []byte("Edited response"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages = buildContextMessages(OS, tempDir, tempDir)
+	if len(messages) != 2 || messages[1].Content != "Edited response" {
+		t.Errorf("Expected the edited response, got %+v", messages)
+	}
+}
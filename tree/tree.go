@@ -0,0 +1,131 @@
+// Package tree keeps a conversation with a language model as a tree of
+// directories, one per node.  Each node holds its prompt in prompt.txt
+// and, once asked, the messages exchanged in messages.json and the
+// response in response.txt; a node's context is the conversation from
+// the root of the tree down to it.
+//
+// A Tree is kept in a Store, either the filesystem or memory.  An
+// Engine asks a node's prompt of a language model:
+//
+//	t := tree.New(tree.OS, "/project/.aidss", "/project")
+//	node, err := t.Node(t.Path).NewChild("next step")
+//	...
+//	err = node.SetPrompt("In: notes.md\n\nSummarize my notes")
+//	...
+//	err = tree.NewEngine(t, client).Ask(ctx, node)
+package tree
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"path/filepath"
+
+	"github.com/stevegt/aidss/llm"
+)
+
+// The files of a node, and of the tree's root
+const (
+	PromptFn     = "prompt.txt"
+	PromptFullFn = "prompt-full.txt"
+	MessagesFn   = "messages.json"
+	SysmsgFn     = "sysmsg.txt"
+	SummaryFn    = "summary.txt"
+	ElidedFn     = "elided.txt"
+	ResponseFn   = "response.txt"
+	NotesFn      = "notes.txt"
+	ErrorFn      = "error.txt"
+	MetricsFn    = "metrics.json"
+	DefaultsFn   = "defaults.txt"
+	TemplatesDir = "templates"
+	IgnoreFn     = "ignore"
+
+	AidssIgnoreFn = ".aidssignore"
+	GitIgnoreFn   = ".gitignore"
+)
+
+// Tree is a decision tree kept in a Store.
+type Tree struct {
+	Store Store
+	Path  string // the root node's directory
+	Root  string // the project root, which In and Out files stay within
+}
+
+// New returns the tree rooted at path in store, for the project at
+// root.
+func New(store Store, path, root string) *Tree {
+	return &Tree{Store: store, Path: path, Root: root}
+}
+
+// Node returns the node at path, which should be within the tree.
+func (t *Tree) Node(path string) *Node {
+	return &Node{Tree: t, Path: path}
+}
+
+// WriteOutFiles writes the <OUT> files found in response that the
+// outFiles entries name, relative to basePath.
+func (t *Tree) WriteOutFiles(response string, outFiles []string, basePath string) error {
+	return processLLMResponse(t.Store, response, outFiles, basePath, t.Root)
+}
+
+// Node is a node of a Tree: a directory holding a prompt and, once it
+// has been asked, the exchange with the language model.
+type Node struct {
+	Tree *Tree
+	Path string
+}
+
+// Parent returns the node's parent, or nil for the tree's root.
+func (n *Node) Parent() *Node {
+	if n.Path == n.Tree.Path || !IsWithin(n.Tree.Path, n.Path) {
+		return nil
+	}
+	return n.Tree.Node(filepath.Dir(n.Path))
+}
+
+// NewChild creates a child node named after descriptor.
+func (n *Node) NewChild(descriptor string) (*Node, error) {
+	path, err := createNewDecisionNode(n.Tree.Store, n.Path, descriptor)
+	if err != nil {
+		return nil, err
+	}
+	return n.Tree.Node(path), nil
+}
+
+// SetPrompt replaces the node's prompt.txt with text.
+func (n *Node) SetPrompt(text string) error {
+	return n.Tree.Store.WriteFile(filepath.Join(n.Path, PromptFn), []byte(text))
+}
+
+// Prompt returns the node's prompt, with the headers it inherits and
+// its template expanded.
+func (n *Node) Prompt() (*Prompt, error) {
+	return loadPrompt(n.Tree.Store, n.Path, n.Tree.Path, n.Tree.Root)
+}
+
+// Transcript returns the messages the node exchanged when it was last
+// asked.
+func (n *Node) Transcript() ([]TranscriptMessage, error) {
+	return loadTranscript(n.Tree.Store, n.Path)
+}
+
+// Messages returns the conversation from the tree's root down to and
+// including the node, without system messages.
+func (n *Node) Messages() []llm.Message {
+	return buildContextMessages(n.Tree.Store, n.Path, n.Tree.Path)
+}
+
+// UpdateMetrics replaces the node's metrics.json with metrics.
+func (n *Node) UpdateMetrics(metrics map[string]interface{}) error {
+	data, err := json.MarshalIndent(metrics, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error marshalling metrics: %v", err)
+	}
+	metricsPath := filepath.Join(n.Path, MetricsFn)
+	err = n.Tree.Store.WriteFileAtomic(metricsPath, data)
+	if err != nil {
+		return fmt.Errorf("error writing metrics: %v", err)
+	}
+	log.Println("Metrics updated at:", metricsPath)
+	return nil
+}
@@ -0,0 +1,96 @@
+package tree
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTreeAPI(t *testing.T) {
+	store := NewMemStore()
+	if err := store.MkdirAll("/project/.aidss"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.WriteFile("/project/notes.md", []byte("Some notes")); err != nil {
+		t.Fatal(err)
+	}
+	tr := New(store, "/project/.aidss", "/project")
+	client := &recordingClient{}
+	engine := NewEngine(tr, client)
+	ctx := context.Background()
+
+	root := tr.Node(tr.Path)
+	if root.Parent() != nil {
+		t.Errorf("Expected the root to have no parent, got %v", root.Parent())
+	}
+	if err := root.SetPrompt("In: notes.md\n\nWhat do my notes say?"); err != nil {
+		t.Fatal(err)
+	}
+	if err := engine.Ask(ctx, root); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(client.lastCall()[0].Content, "Some notes") {
+		t.Errorf("Expected the In file in the request, got %v", client.lastCall())
+	}
+
+	// A child carries on the conversation
+	child, err := root.NewChild("follow up")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(filepath.Base(child.Path), "follow_up_") {
+		t.Errorf("Expected a follow_up_ node, got %s", child.Path)
+	}
+	if parent := child.Parent(); parent == nil || parent.Path != root.Path {
+		t.Errorf("Expected the root as parent, got %v", parent)
+	}
+	if err := child.SetPrompt("And then?"); err != nil {
+		t.Fatal(err)
+	}
+	prompt, err := child.Prompt()
+	if err != nil || prompt.PromptText != "And then?" {
+		t.Errorf("Expected the child's prompt, got %v, %v", prompt, err)
+	}
+
+	// Preview shows what Ask will send, without sending it
+	var buf bytes.Buffer
+	if err := child.Preview(&buf, client.Model()); err != nil {
+		t.Fatal(err)
+	}
+	if len(client.calls) != 1 || !strings.Contains(buf.String(), "And then?") {
+		t.Errorf("Expected a preview of the child's request only, got %d calls and:\n%s", len(client.calls), buf.String())
+	}
+
+	if err := engine.Ask(ctx, child); err != nil {
+		t.Fatal(err)
+	}
+	messages := child.Messages()
+	if len(messages) != 4 || messages[3].Content != "Recorded response." {
+		t.Errorf("Expected both turns, got %v", messages)
+	}
+	transcript, err := child.Transcript()
+	if err != nil || len(transcript) != 2 {
+		t.Errorf("Expected the child's own turn, got %v, %v", transcript, err)
+	}
+
+	summary, err := engine.Summarize(ctx, child)
+	if err != nil || summary != "Recorded response." {
+		t.Errorf("Expected a summary, got %q, %v", summary, err)
+	}
+
+	err = child.UpdateMetrics(map[string]interface{}{"score": 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := store.ReadFile(filepath.Join(child.Path, MetricsFn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var metrics map[string]int
+	if err := json.Unmarshal(data, &metrics); err != nil || metrics["score"] != 3 {
+		t.Errorf("Expected the metrics saved, got %s, %v", data, err)
+	}
+}
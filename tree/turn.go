@@ -0,0 +1,86 @@
+package tree
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Turn is the user's turn at a node: the prompt text, the In files
+// attached to it and the excerpts retrieved for it.  Each node stores
+// only its own turn, as the user message of its messages.json, so that
+// rebuilding the conversation from the root to a node includes every
+// turn once.
+type Turn struct {
+	Prompt      string       `json:"prompt"`
+	Attachments []Attachment `json:"attachments,omitempty"`
+	Excerpts    []Excerpt    `json:"excerpts,omitempty"`
+}
+
+// Attachment is an In file attached to a turn.
+type Attachment struct {
+	Filename string `json:"filename"`
+	Content  string `json:"content"`
+}
+
+// Excerpt is a chunk of a file retrieved as relevant to a turn's
+// prompt.
+type Excerpt struct {
+	Filename string `json:"filename"`
+	Page     int    `json:"page,omitempty"` // 0 for files without pages
+	Line     int    `json:"line,omitempty"`
+	Content  string `json:"content"`
+}
+
+// Tag returns the opening tag the excerpt is sent with, which the LLM
+// can cite.
+func (e Excerpt) Tag() string {
+	tag := fmt.Sprintf("<EXCERPT filename=\"%s\"", e.Filename)
+	if e.Page > 0 {
+		tag += fmt.Sprintf(" page=\"%d\"", e.Page)
+	}
+	if e.Line > 0 {
+		tag += fmt.Sprintf(" line=\"%d\"", e.Line)
+	}
+	return tag + ">"
+}
+
+// Content returns the user message sent to the LLM for the turn.
+func (t *Turn) Content() string {
+	content := fmt.Sprintf("%s\n\n", t.Prompt)
+	if len(t.Attachments) > 0 {
+		var builder strings.Builder
+		for _, a := range t.Attachments {
+			builder.WriteString(fmt.Sprintf("<IN filename=\"%s\">\n%s\n</IN>\n", a.Filename, a.Content))
+		}
+		content += "The following files are attached:\n" + builder.String() + "\n"
+	}
+	if len(t.Excerpts) > 0 {
+		var builder strings.Builder
+		for _, e := range t.Excerpts {
+			builder.WriteString(fmt.Sprintf("%s\n%s\n</EXCERPT>\n", e.Tag(), e.Content))
+		}
+		content += "The following excerpts were retrieved as relevant; cite them by filename and page or line:\n" + builder.String() + "\n"
+	}
+	return content
+}
+
+// readInFiles reads the In files, resolved relative to basePath and
+// confined to rootPath.
+func readInFiles(store Store, inFiles []string, basePath, rootPath string) ([]Attachment, error) {
+	var attachments []Attachment
+	for _, relPath := range inFiles {
+		absPath, err := resolvePath(store, rootPath, basePath, relPath)
+		if err != nil {
+			return nil, fmt.Errorf("error resolving In file: %v", err)
+		}
+		data, err := store.ReadFile(absPath)
+		if err != nil {
+			return nil, fmt.Errorf("error reading file %s: %v", absPath, err)
+		}
+		attachments = append(attachments, Attachment{
+			Filename: relPath,
+			Content:  string(data),
+		})
+	}
+	return attachments, nil
+}
@@ -0,0 +1,231 @@
+package tree
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Watcher backends, as named by the --watcher flag.
+const (
+	WatchAuto     = "auto"     // fsnotify, falling back to polling
+	WatchFsnotify = "fsnotify" // kernel notifications only
+	WatchPoll     = "poll"     // scanning only
+)
+
+// WatchBackends lists the watcher backends, for usage and validation.
+var WatchBackends = []string{WatchAuto, WatchFsnotify, WatchPoll}
+
+// DefaultPollInterval is how often the polling watcher scans by
+// default.
+const DefaultPollInterval = 2 * time.Second
+
+// Watcher reports changes to the entries of the directories added to
+// it, non-recursively, as fsnotify does.
+type Watcher interface {
+	Add(dir string) error
+	Remove(dir string) error
+	WatchList() []string
+	Events() <-chan fsnotify.Event
+	Errors() <-chan error
+	Close() error
+}
+
+// NewWatcher returns a watcher using backend, one of WatchBackends.
+// The polling watcher scans every interval.
+func NewWatcher(backend string, interval time.Duration) (Watcher, error) {
+	switch backend {
+	case WatchFsnotify:
+		return newFsnotifyWatcher()
+	case WatchPoll:
+		return newPollWatcher(interval), nil
+	case WatchAuto:
+		return newAutoWatcher(interval), nil
+	}
+	return nil, fmt.Errorf("unknown watcher %q, expected one of %v", backend, WatchBackends)
+}
+
+// inotifyLimit reports whether err means a kernel limit on inotify
+// instances or watches has been reached.
+func inotifyLimit(err error) bool {
+	return errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENOSPC)
+}
+
+// fsnotifyWatcher is a Watcher using the kernel's notifications.
+type fsnotifyWatcher struct {
+	*fsnotify.Watcher
+}
+
+// newFsnotifyWatcher returns a watcher using fsnotify.
+func newFsnotifyWatcher() (*fsnotifyWatcher, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	return &fsnotifyWatcher{w}, nil
+}
+
+// Events returns the channel of events.
+func (w *fsnotifyWatcher) Events() <-chan fsnotify.Event {
+	return w.Watcher.Events
+}
+
+// Errors returns the channel of errors.
+func (w *fsnotifyWatcher) Errors() <-chan error {
+	return w.Watcher.Errors
+}
+
+// autoWatcher uses fsnotify until the kernel runs out of inotify
+// instances or watches, then moves every watch to a polling watcher.
+type autoWatcher struct {
+	interval time.Duration
+	events   chan fsnotify.Event
+	errors   chan error
+	done     chan struct{}  // closed by Close
+	wg       sync.WaitGroup // forwarders
+
+	mu      sync.Mutex
+	current Watcher
+	polling bool
+	closed  bool
+}
+
+// newAutoWatcher returns a watcher that starts with fsnotify if it can
+// and falls back to polling every interval.
+func newAutoWatcher(interval time.Duration) *autoWatcher {
+	fw, err := newFsnotifyWatcher()
+	if err != nil {
+		log.Println("Can't use fsnotify, polling instead:", err)
+		w := startAutoWatcher(newPollWatcher(interval), interval)
+		w.polling = true
+		return w
+	}
+	return startAutoWatcher(fw, interval)
+}
+
+// startAutoWatcher returns an autoWatcher starting with backend.
+func startAutoWatcher(backend Watcher, interval time.Duration) *autoWatcher {
+	w := &autoWatcher{
+		interval: interval,
+		events:   make(chan fsnotify.Event),
+		errors:   make(chan error),
+		done:     make(chan struct{}),
+	}
+	w.use(backend)
+	return w
+}
+
+// use makes backend the current watcher and forwards its events until
+// it is closed.  Callers must hold w.mu, if anyone else can.
+func (w *autoWatcher) use(backend Watcher) {
+	w.current = backend
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		events, errs := backend.Events(), backend.Errors()
+		for events != nil || errs != nil {
+			select {
+			case event, ok := <-events:
+				if !ok {
+					events = nil
+					continue
+				}
+				select {
+				case w.events <- event:
+				case <-w.done:
+					return
+				}
+			case err, ok := <-errs:
+				if !ok {
+					errs = nil
+					continue
+				}
+				select {
+				case w.errors <- err:
+				case <-w.done:
+					return
+				}
+			}
+		}
+	}()
+}
+
+// Add watches dir, switching to polling if fsnotify has hit a limit.
+func (w *autoWatcher) Add(dir string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	err := w.current.Add(dir)
+	if w.polling || !inotifyLimit(err) {
+		return err
+	}
+
+	log.Printf("Hit the inotify limit (%v), polling every %v instead", err, w.interval)
+	pw := newPollWatcher(w.interval)
+	for _, watched := range append(w.current.WatchList(), dir) {
+		err := pw.Add(watched)
+		if err != nil {
+			pw.Close()
+			return err
+		}
+	}
+	old := w.current
+	w.use(pw)
+	w.polling = true
+	// The old forwarder may be blocked sending to our caller, so
+	// don't wait for it
+	go old.Close()
+	return nil
+}
+
+// Remove stops watching dir.
+func (w *autoWatcher) Remove(dir string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.current.Remove(dir)
+}
+
+// WatchList returns the directories watched.
+func (w *autoWatcher) WatchList() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.current.WatchList()
+}
+
+// Events returns the channel of events.
+func (w *autoWatcher) Events() <-chan fsnotify.Event {
+	return w.events
+}
+
+// Errors returns the channel of errors.
+func (w *autoWatcher) Errors() <-chan error {
+	return w.errors
+}
+
+// Polling reports whether the watcher has fallen back to polling.
+func (w *autoWatcher) Polling() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.polling
+}
+
+// Close stops watching and closes the channels.
+func (w *autoWatcher) Close() error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return nil
+	}
+	w.closed = true
+	err := w.current.Close()
+	w.mu.Unlock()
+	close(w.done)
+	w.wg.Wait()
+	close(w.events)
+	close(w.errors)
+	return err
+}
@@ -0,0 +1,166 @@
+package tree
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+func TestPollWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_poll")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	w := newPollWatcher(10 * time.Millisecond)
+	defer w.Close()
+	err = w.Add(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Add(filepath.Join(dir, "missing")); !os.IsNotExist(err) {
+		t.Errorf("Expected a missing directory to be an error, got %v", err)
+	}
+
+	expect := func(op fsnotify.Op, name string) {
+		t.Helper()
+		select {
+		case event := <-w.Events():
+			if event.Op != op || event.Name != name {
+				t.Errorf("Expected %v %s, got %v", op, name, event)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("Expected %v %s, got nothing", op, name)
+		}
+	}
+
+	name := filepath.Join(dir, PromptFn)
+	err = ioutil.WriteFile(name, []byte("Hello"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(fsnotify.Create, name)
+
+	// A save that leaves the size and modification time as they were
+	// is caught by the hash
+	fi, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(name, []byte("Howdy"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chtimes(name, fi.ModTime(), fi.ModTime())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(fsnotify.Write, name)
+
+	err = ioutil.WriteFile(name, []byte("Hello, world"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(fsnotify.Write, name)
+
+	sub := filepath.Join(dir, "sub")
+	err = os.Mkdir(sub, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(fsnotify.Create, sub)
+
+	err = os.Remove(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(fsnotify.Remove, name)
+
+	if err := w.Remove(dir); err != nil {
+		t.Errorf("Expected to remove the watch, got %v", err)
+	}
+	if err := w.Remove(dir); err == nil {
+		t.Errorf("Expected an error removing a watch twice")
+	}
+
+	w.Close()
+	if _, ok := <-w.Events(); ok {
+		t.Errorf("Expected the events channel to be closed")
+	}
+}
+
+// limitedWatcher is an fsnotify watcher that hits the inotify watch
+// limit after a number of watches.
+type limitedWatcher struct {
+	*fsnotifyWatcher
+	limit int
+}
+
+func (w *limitedWatcher) Add(dir string) error {
+	if len(w.WatchList()) >= w.limit {
+		return syscall.ENOSPC
+	}
+	return w.fsnotifyWatcher.Add(dir)
+}
+
+func TestAutoWatcherFallback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test_auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, sub := range []string{"a", "b"} {
+		err = os.Mkdir(filepath.Join(dir, sub), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fw, err := newFsnotifyWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := startAutoWatcher(&limitedWatcher{fw, 2}, 10*time.Millisecond)
+	defer w.Close()
+	for _, p := range []string{dir, filepath.Join(dir, "a")} {
+		if err := w.Add(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if w.Polling() {
+		t.Fatal("Expected fsnotify below the limit")
+	}
+
+	// The third watch moves every watch to polling
+	if err := w.Add(filepath.Join(dir, "b")); err != nil {
+		t.Fatal(err)
+	}
+	if !w.Polling() {
+		t.Fatal("Expected polling at the limit")
+	}
+	expected := []string{dir, filepath.Join(dir, "a"), filepath.Join(dir, "b")}
+	if got := w.WatchList(); !equalStringSlices(got, expected) {
+		t.Errorf("Expected watches %v, got %v", expected, got)
+	}
+
+	// Events keep arriving on the same channel
+	name := filepath.Join(dir, "b", PromptFn)
+	err = ioutil.WriteFile(name, []byte("Hello"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case event := <-w.Events():
+		if event.Name != name || event.Op != fsnotify.Create {
+			t.Errorf("Expected a Create of %s, got %v", name, event)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Expected an event from the polling watcher")
+	}
+}